@@ -5,6 +5,7 @@ import (
 	"errors"
 	"flag"
 	"fmt"
+	"io/fs"
 	"log"
 	"os"
 	"os/signal"
@@ -12,8 +13,8 @@ import (
 
 	"github.com/brutella/hap"
 	"github.com/brutella/hap/accessory"
-	"github.com/brutella/hap/service"
 	"github.com/yangl1996/nesthub/internal/config"
+	"github.com/yangl1996/nesthub/internal/doctor"
 	"github.com/yangl1996/nesthub/internal/helpers"
 	"github.com/yangl1996/nesthub/internal/onboard"
 	"github.com/yangl1996/nesthub/pkg/emulation"
@@ -23,18 +24,49 @@ func main() {
 	ctx := context.Background()
 
 	configPathFlag := flag.String("config", "config.json", "path to the config file")
+	setupHeadlessFlag := flag.Bool("setup-headless", false, "authorize the oauth token by pasting the redirect URL, for machines without a browser")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] [init|doctor]\n\n", os.Args[0])
+		fmt.Fprintln(flag.CommandLine.Output(), "  init\tcreate the config file interactively")
+		fmt.Fprintln(flag.CommandLine.Output(), "  doctor\tcheck the Google setup without starting the bridge")
+		fmt.Fprintln(flag.CommandLine.Output())
+		flag.PrintDefaults()
+	}
 	flag.Parse()
 
-	// TODO if config doesn't exist, template the config
+	switch flag.Arg(0) {
+	case "":
+	case "init":
+		if err := config.Init(*configPathFlag, os.Stdin, os.Stdout); err != nil {
+			log.Fatalf("failed to create config: %v", err)
+		}
+
+		return
+	case "doctor":
+		if !doctor.Run(ctx, *configPathFlag, os.Stdout) {
+			os.Exit(1)
+		}
+
+		return
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+
 	// Confirm config is valid
 	cfg, err := config.NewConfig(*configPathFlag)
-	if err != nil {
+	if errors.Is(err, fs.ErrNotExist) {
+		log.Fatalf("config file %s not found, run '%s init' to create it", *configPathFlag, os.Args[0])
+	} else if err != nil {
 		log.Fatalf("failed to load config: %v", err)
 	}
 
-	// Confirm SDM is enabled
+	// Confirm SDM is enabled, which takes the service account the pubsub
+	// emulator runs without
 	const sdmSvcName = "smartdevicemanagement.googleapis.com"
-	if err := onboard.SvcEnabled(ctx, cfg, sdmSvcName); errors.Is(err, helpers.ErrSvcNotEnabled) {
+	if cfg.PubsubEmulated() {
+		log.Println("pubsub emulator configured, not checking if smart device management service is enabled")
+	} else if err := onboard.SvcEnabled(ctx, cfg, sdmSvcName); errors.Is(err, helpers.ErrSvcNotEnabled) {
 		log.Println("smart device management service not enabled")
 
 		if err := onboard.EnableSvc(ctx, cfg, sdmSvcName); err != nil {
@@ -44,8 +76,23 @@ func main() {
 		log.Fatalf("failed to check if smart device management service is enabled: %v", err)
 	}
 
+	// Confirm pubsub subscription exists
+	if err := onboard.SubscriptionExists(ctx, cfg); errors.Is(err, helpers.ErrSubscriptionNotFound) {
+		log.Println("pubsub subscription not found")
+
+		if err := onboard.CreateSubscription(ctx, cfg); err != nil {
+			log.Fatalf("failed to create pubsub subscription: %v", err)
+		}
+	} else if err != nil {
+		log.Fatalf("failed to check if pubsub subscription exists: %v", err)
+	}
+
 	// Confirm oauth token is valid
-	if _, err := cfg.NewOAuthTokenSource(ctx); err != nil {
+	if *setupHeadlessFlag {
+		if err := onboard.AuthorizeOAuthTokenHeadless(ctx, cfg, os.Stdin, os.Stdout); err != nil {
+			log.Fatalf("failed to authorize oath token: %v", err)
+		}
+	} else if _, err := cfg.NewOAuthTokenSource(ctx); err != nil {
 		log.Println("invalid or missing oauth token")
 
 		if err := onboard.AuthorizeOAuthToken(ctx, cfg); err != nil {
@@ -53,23 +100,37 @@ func main() {
 		}
 	}
 
-	s := service.NewThermostat()
 	a := accessory.NewBridge(accessory.Info{
 		Name:         cfg.HubName,
 		Manufacturer: "github.com/yangl1996/nesthub",
 	})
 
-	a.AddS(s.S)
+	// the hub and the server run until SIGINT or SIGTERM
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+
+	ctx, cancel := context.WithCancel(ctx)
 
-	if _, err := emulation.NewEmulatedDevice(ctx, cfg, s); err != nil {
-		log.Fatalf("failed to create emulated device: %s", err)
+	go func() {
+		<-c
+		signal.Stop(c)
+		cancel()
+	}()
+
+	hub, err := emulation.NewHub(ctx, cfg)
+	if err != nil {
+		if ctx.Err() != nil {
+			log.Println("Stopped before device emulation started")
+			return
+		}
+		log.Fatalf("failed to create emulated devices: %s", err)
 	}
 
 	log.Println("Device emulation started")
 
 	fs := hap.NewFsStore(cfg.StoragePath)
 
-	server, err := hap.NewServer(fs, a.A)
+	server, err := hap.NewServer(fs, a.A, hub.Accessories()...)
 	if err != nil {
 		log.Fatalf("failed to start transport: %s", err)
 	}
@@ -77,17 +138,36 @@ func main() {
 	server.Pin = cfg.PairingCode
 	server.Addr = cfg.Address
 
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
-
-	ctx, cancel := context.WithCancel(context.Background())
+	// Reload the config on SIGHUP
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
 
 	go func() {
-		<-c
-		signal.Stop(c)
-		cancel()
+		for range hup {
+			cfg = reloadConfig(*configPathFlag, cfg, hub)
+		}
 	}()
 
 	// Run the server
 	fmt.Printf("Server exited: %s\n", server.ListenAndServe(ctx))
 }
+
+// reloadConfig reads the config file again and applies the fields that can be
+// changed while running. It returns the config in effect afterwards.
+func reloadConfig(path string, cfg *config.Config, hub *emulation.Hub) *config.Config {
+	next, refused, err := cfg.Reload(path)
+	if err != nil {
+		log.Printf("Not reloading config: %v", err)
+		return cfg
+	}
+
+	for _, field := range refused {
+		log.Printf("Not reloading config field %s, restart nesthub to apply it", field)
+	}
+
+	hub.Reconfigure(next)
+
+	log.Println("Config reloaded")
+
+	return next
+}
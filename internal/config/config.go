@@ -1,100 +1,206 @@
 package config
 
 import (
-	"errors"
 	"fmt"
+	"os"
+	"time"
 
 	"github.com/yangl1996/nesthub/internal/helpers"
 )
 
+// Config is loaded from a JSON file. Every field can be overridden by an
+// environment variable named after its env tag, fields tagged secret can be
+// read from a file as well, see applyEnvOverrides.
 type Config struct {
 	// HubName is the name of the hub
-	HubName string `json:"HubName,omitempty"`
+	HubName string `json:"HubName,omitempty" env:"HUB_NAME"`
 
 	// SDMProjectID is the project ID shown in the SDM console
-	SDMProjectID string `json:"SDMProjectID,omitempty"`
+	SDMProjectID string `json:"SDMProjectID,omitempty" env:"SDM_PROJECT_ID"`
 
 	// GCPProjectID is the project ID shown in the GCP console
-	GCPProjectID string `json:"GCPProjectID,omitempty"`
+	GCPProjectID string `json:"GCPProjectID,omitempty" env:"GCP_PROJECT_ID"`
 
 	// OAuthClientID is the oauth client ID created in GCP and set in SDM project
-	OAuthClientID string `json:"OAuthClientID,omitempty"`
+	OAuthClientID string `json:"OAuthClientID,omitempty" env:"OAUTH_CLIENT_ID,secret"`
 
 	// OAuthClientSecret is the oauth client secret created in GCP
-	OAuthClientSecret string `json:"OAuthClientSecret,omitempty"`
+	OAuthClientSecret string `json:"OAuthClientSecret,omitempty" env:"OAUTH_CLIENT_SECRET,secret"`
 
 	// OAuthTokenPath is the path to the oauth token
-	OAuthTokenPath string `json:"OAuthToken,omitempty"`
+	OAuthTokenPath string `json:"OAuthToken,omitempty" env:"OAUTH_TOKEN"`
 
 	// ServiceAccountKey credentials of the service account of GCP project
-	ServiceAccountKey string `json:"ServiceAccountKey,omitempty"`
+	ServiceAccountKey string `json:"ServiceAccountKey,omitempty" env:"SERVICE_ACCOUNT_KEY"`
 
 	// PairingCode is the 8 digit pairing code
-	PairingCode string `json:"PairingCode,omitempty"`
+	PairingCode string `json:"PairingCode,omitempty" env:"PAIRING_CODE,secret"`
 
 	// Address is the host:port combintion that homekit will connect to, optional
-	Address string `json:"Address,omitempty"`
+	Address string `json:"Address,omitempty" env:"ADDRESS"`
 
 	// StoragePath is the filepath where connection data is stored
-	StoragePath string `json:"StoragePath,omitempty"`
+	StoragePath string `json:"StoragePath,omitempty" env:"STORAGE_PATH"`
 
 	// An http server is required during nesthub setup, you can use this field to specify a
 	// network address to use. (default: http://localhost:7979)
-	SetupRedirectUri string `json:"SetupRedirectUri,omitempty"`
+	SetupRedirectUri string `json:"SetupRedirectUri,omitempty" env:"SETUP_REDIRECT_URI"`
+
+	// SetupTimeout is how long nesthub setup waits for the oauth authorization, in the browser
+	// or pasted with -setup-headless
+	// (default: 10m)
+	SetupTimeout string `json:"SetupTimeout,omitempty" env:"SETUP_TIMEOUT"`
+
+	// PubsubSubscription is the ID of the pubsub subscription to the SDM events of the GCP
+	// project, it is created if missing (default: homebridge-pubsub)
+	PubsubSubscription string `json:"PubsubSubscription,omitempty" env:"PUBSUB_SUBSCRIPTION"`
+
+	// FanDuration is how long the fan runs when turned on from HomeKit, e.g. "15m" (default: 1h)
+	FanDuration string `json:"FanDuration,omitempty" env:"FAN_DURATION"`
+
+	// SensorHoldTime is how long camera motion, person and sound sensors stay triggered after
+	// an event, e.g. "1m" (default: 30s)
+	SensorHoldTime string `json:"SensorHoldTime,omitempty" env:"SENSOR_HOLD_TIME"`
+
+	// PollInterval is how often the state of the devices is fetched from the SDM API to
+	// recover from missed pubsub events, e.g. "30m" (default: 15m)
+	PollInterval string `json:"PollInterval,omitempty" env:"POLL_INTERVAL"`
+
+	// PubsubEmulatorHost is the host:port of a pubsub emulator to use instead of Google Cloud,
+	// without credentials. The PUBSUB_EMULATOR_HOST environment variable is honoured as well.
+	PubsubEmulatorHost string `json:"PubsubEmulatorHost,omitempty" env:"PUBSUB_EMULATOR_HOST"`
 }
 
 func NewConfig(path string) (*Config, error) {
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+// LoadConfig reads the config like NewConfig, but only checks the fields and
+// not the paths they name, for callers checking the paths on their own
+func LoadConfig(path string) (*Config, error) {
 	cfg := &Config{}
 	if err := helpers.JsonUnmarshalFile(path, cfg); err != nil {
 		return nil, fmt.Errorf("failed to read config file: %w", err)
 	}
 
-	if err := cfg.validateRequiredFields(); err != nil {
-		return nil, fmt.Errorf("invalid config: %w", err)
+	if err := cfg.applyEnvOverrides(os.LookupEnv); err != nil {
+		return nil, fmt.Errorf("invalid environment: %w", err)
 	}
 
 	cfg.populateOptionalFields()
 
+	errs := cfg.missingFields()
+	errs = append(errs, cfg.invalidFields()...)
+
+	if err := helpers.ErrListToErr("invalid config", errs); err != nil {
+		return nil, err
+	}
+
 	return cfg, nil
 }
 
+// Validate checks every field of the config. The error is a *helpers.ErrList
+// holding a *FieldError for each invalid field, use errors.As to inspect them.
+func (cfg *Config) Validate() error {
+	errs := cfg.missingFields()
+	errs = append(errs, cfg.invalidFields()...)
+	errs = append(errs, cfg.invalidPaths()...)
+
+	return helpers.ErrListToErr("invalid config", errs)
+}
+
 // validateRequiredFields checks that all required config fields exist
 func (cfg *Config) validateRequiredFields() error {
+	return helpers.ErrListToErr("config missing fields", cfg.missingFields())
+}
+
+func (cfg *Config) missingFields() []error {
 	errs := []error{}
 
-	if cfg.HubName == "" {
-		errs = append(errs, errors.New("HubName"))
+	required := []struct {
+		field string
+		value string
+	}{
+		{"HubName", cfg.HubName},
+		{"SDMProjectID", cfg.SDMProjectID},
+		{"GCPProjectID", cfg.GCPProjectID},
+		{"OAuthClientID", cfg.OAuthClientID},
+		{"OAuthClientSecret", cfg.OAuthClientSecret},
+		{"OAuthToken", cfg.OAuthTokenPath},
+		{"PairingCode", cfg.PairingCode},
+		{"StoragePath", cfg.StoragePath},
 	}
 
-	if cfg.SDMProjectID == "" {
-		errs = append(errs, errors.New("SDMProjectID"))
+	for _, r := range required {
+		if r.value == "" {
+			errs = append(errs, &FieldError{Field: r.field, Err: ErrRequired})
+		}
 	}
 
-	if cfg.GCPProjectID == "" {
-		errs = append(errs, errors.New("GCPProjectID"))
+	// the service account is only used for Google Cloud pubsub and the
+	// Service Usage API, neither of which is used with a pubsub emulator
+	if cfg.ServiceAccountKey == "" && !cfg.PubsubEmulated() {
+		errs = append(errs, &FieldError{Field: "ServiceAccountKey", Err: ErrRequired})
 	}
 
-	if cfg.OAuthClientID == "" {
-		errs = append(errs, errors.New("OAuthClientID"))
+	return errs
+}
+
+func (cfg *Config) populateOptionalFields() {
+	if cfg.SetupRedirectUri == "" {
+		cfg.SetupRedirectUri = "http://localhost:7979"
 	}
 
-	if cfg.OAuthClientSecret == "" {
-		errs = append(errs, errors.New("OAuthClientSecret"))
+	if cfg.SetupTimeout == "" {
+		cfg.SetupTimeout = "10m"
 	}
 
-	if cfg.OAuthTokenPath == "" {
-		errs = append(errs, errors.New("OAuthToken"))
+	if cfg.PubsubSubscription == "" {
+		cfg.PubsubSubscription = "homebridge-pubsub"
 	}
 
-	if cfg.ServiceAccountKey == "" {
-		errs = append(errs, errors.New("ServiceAccountKey"))
+	if cfg.FanDuration == "" {
+		cfg.FanDuration = "1h"
 	}
 
-	return helpers.ErrListToErr("config missing fields", errs)
-}
+	if cfg.SensorHoldTime == "" {
+		cfg.SensorHoldTime = "30s"
+	}
 
-func (cfg *Config) populateOptionalFields() {
-	if cfg.SetupRedirectUri == "" {
-		cfg.SetupRedirectUri = "http://localhost:7979"
+	if cfg.PollInterval == "" {
+		cfg.PollInterval = "15m"
 	}
 }
+
+// FanTimerDuration returns the parsed FanDuration
+func (cfg *Config) FanTimerDuration() time.Duration {
+	d, _ := time.ParseDuration(cfg.FanDuration)
+	return d
+}
+
+// SensorHoldDuration returns the parsed SensorHoldTime
+func (cfg *Config) SensorHoldDuration() time.Duration {
+	d, _ := time.ParseDuration(cfg.SensorHoldTime)
+	return d
+}
+
+// PollIntervalDuration returns the parsed PollInterval
+func (cfg *Config) PollIntervalDuration() time.Duration {
+	d, _ := time.ParseDuration(cfg.PollInterval)
+	return d
+}
+
+// SetupTimeoutDuration returns the parsed SetupTimeout
+func (cfg *Config) SetupTimeoutDuration() time.Duration {
+	d, _ := time.ParseDuration(cfg.SetupTimeout)
+	return d
+}
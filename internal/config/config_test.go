@@ -1,23 +1,34 @@
 package config
 
 import (
+	"errors"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/yangl1996/nesthub/internal/helpers"
 )
 
 func newTestConfig() Config {
 	return Config{
-		HubName:           "my",
-		SDMProjectID:      "guitar",
-		GCPProjectID:      "gently",
-		OAuthClientID:     "weaps",
-		OAuthClientSecret: "hey",
-		OAuthTokenPath:    "jude",
-		ServiceAccountKey: "here",
-		PairingCode:       "comes",
-		StoragePath:       "the",
-		SetupRedirectUri:  "sun",
+		HubName:            "my",
+		SDMProjectID:       "guitar",
+		GCPProjectID:       "gently",
+		OAuthClientID:      "weaps",
+		OAuthClientSecret:  "hey",
+		OAuthTokenPath:     "jude",
+		ServiceAccountKey:  "here",
+		PairingCode:        "77887788",
+		StoragePath:        "the",
+		SetupRedirectUri:   "http://sun:7979",
+		SetupTimeout:       "5m",
+		PubsubSubscription: "little",
+		FanDuration:        "15m",
+		SensorHoldTime:     "1m",
+		PollInterval:       "30m",
 	}
 }
 
@@ -53,9 +64,13 @@ func TestPopulateOptionalFields(t *testing.T) {
 		t.Parallel()
 		tempConfig := newTestConfig()
 		tempConfig.populateOptionalFields()
-		assert.Equal(t, "comes", tempConfig.PairingCode)
+		assert.Equal(t, "77887788", tempConfig.PairingCode)
 		assert.Equal(t, "the", tempConfig.StoragePath)
-		assert.Equal(t, "sun", tempConfig.SetupRedirectUri)
+		assert.Equal(t, "http://sun:7979", tempConfig.SetupRedirectUri)
+		assert.Equal(t, "5m", tempConfig.SetupTimeout)
+		assert.Equal(t, "little", tempConfig.PubsubSubscription)
+		assert.Equal(t, "15m", tempConfig.FanDuration)
+		assert.Equal(t, "30m", tempConfig.PollInterval)
 	})
 
 	t.Run("changes", func(t *testing.T) {
@@ -64,9 +79,162 @@ func TestPopulateOptionalFields(t *testing.T) {
 		tempConfig.PairingCode = ""
 		tempConfig.StoragePath = ""
 		tempConfig.SetupRedirectUri = ""
+		tempConfig.SetupTimeout = ""
+		tempConfig.PubsubSubscription = ""
+		tempConfig.FanDuration = ""
+		tempConfig.SensorHoldTime = ""
+		tempConfig.PollInterval = ""
 		tempConfig.populateOptionalFields()
 		assert.Equal(t, "", tempConfig.PairingCode)
 		assert.Equal(t, "", tempConfig.StoragePath)
 		assert.Equal(t, "http://localhost:7979", tempConfig.SetupRedirectUri)
+		assert.Equal(t, "10m", tempConfig.SetupTimeout)
+		assert.Equal(t, "homebridge-pubsub", tempConfig.PubsubSubscription)
+		assert.Equal(t, "1h", tempConfig.FanDuration)
+		assert.Equal(t, "30s", tempConfig.SensorHoldTime)
+		assert.Equal(t, "15m", tempConfig.PollInterval)
+	})
+}
+
+func TestInvalidFields(t *testing.T) {
+	t.Parallel()
+
+	t.Run("success", func(t *testing.T) {
+		t.Parallel()
+		tempConfig := newTestConfig()
+		assert.Empty(t, tempConfig.invalidFields())
+		assert.Equal(t, 5*time.Minute, tempConfig.SetupTimeoutDuration())
+		assert.Equal(t, 15*time.Minute, tempConfig.FanTimerDuration())
+		assert.Equal(t, time.Minute, tempConfig.SensorHoldDuration())
+		assert.Equal(t, 30*time.Minute, tempConfig.PollIntervalDuration())
+	})
+
+	t.Run("malformed fan duration", func(t *testing.T) {
+		t.Parallel()
+		tempConfig := newTestConfig()
+		tempConfig.FanDuration = "forever"
+		assert.NotEmpty(t, tempConfig.invalidFields())
+	})
+
+	t.Run("fan duration out of range", func(t *testing.T) {
+		t.Parallel()
+		tempConfig := newTestConfig()
+		tempConfig.FanDuration = "13h"
+		assert.NotEmpty(t, tempConfig.invalidFields())
+	})
+
+	t.Run("malformed sensor hold time", func(t *testing.T) {
+		t.Parallel()
+		tempConfig := newTestConfig()
+		tempConfig.SensorHoldTime = "-5s"
+		assert.NotEmpty(t, tempConfig.invalidFields())
+	})
+
+	t.Run("poll interval too short", func(t *testing.T) {
+		t.Parallel()
+		tempConfig := newTestConfig()
+		tempConfig.PollInterval = "10s"
+		assert.NotEmpty(t, tempConfig.invalidFields())
+	})
+}
+
+func TestValidate(t *testing.T) {
+	t.Parallel()
+
+	newValidConfig := func(t *testing.T) Config {
+		t.Helper()
+
+		dir := t.TempDir()
+		key := filepath.Join(dir, "key.json")
+		require.NoError(t, os.WriteFile(key, []byte("{}"), 0o600))
+
+		tempConfig := newTestConfig()
+		tempConfig.ServiceAccountKey = key
+		tempConfig.OAuthTokenPath = filepath.Join(dir, "token.json")
+		tempConfig.StoragePath = filepath.Join(dir, "data", "hap")
+
+		return tempConfig
+	}
+
+	fieldErrors := func(err error) map[string]error {
+		fields := map[string]error{}
+
+		var list *helpers.ErrList
+		if errors.As(err, &list) {
+			for _, e := range list.Errs {
+				var fe *FieldError
+				if errors.As(e, &fe) {
+					fields[fe.Field] = fe.Err
+				}
+			}
+		}
+
+		return fields
+	}
+
+	t.Run("success", func(t *testing.T) {
+		t.Parallel()
+		tempConfig := newValidConfig(t)
+		assert.NoError(t, tempConfig.Validate())
+	})
+
+	t.Run("every problem is reported", func(t *testing.T) {
+		t.Parallel()
+		tempConfig := newValidConfig(t)
+		tempConfig.HubName = ""
+		tempConfig.PairingCode = "12345678"
+		tempConfig.Address = "12345"
+		tempConfig.SetupRedirectUri = "ftp://localhost:7979"
+		tempConfig.ServiceAccountKey = filepath.Join(t.TempDir(), "missing.json")
+		tempConfig.OAuthTokenPath = filepath.Join(t.TempDir(), "missing", "token.json")
+
+		err := tempConfig.Validate()
+		assert.True(t, errors.Is(err, ErrRequired))
+
+		var fe *FieldError
+		assert.True(t, errors.As(err, &fe))
+
+		fields := fieldErrors(err)
+		assert.Len(t, fields, 6)
+		assert.Equal(t, ErrRequired, fields["HubName"])
+
+		for _, f := range []string{"PairingCode", "Address", "SetupRedirectUri", "ServiceAccountKey", "OAuthToken"} {
+			assert.Contains(t, fields, f)
+		}
+	})
+
+	t.Run("storage path under a file", func(t *testing.T) {
+		t.Parallel()
+		tempConfig := newValidConfig(t)
+		tempConfig.StoragePath = filepath.Join(tempConfig.ServiceAccountKey, "data")
+		assert.Contains(t, fieldErrors(tempConfig.Validate()), "StoragePath")
+	})
+}
+
+func TestFieldValidators(t *testing.T) {
+	t.Parallel()
+
+	t.Run("address", func(t *testing.T) {
+		t.Parallel()
+
+		for _, addr := range []string{":12345", "0.0.0.0:12345", "[::1]:80"} {
+			assert.NoError(t, validateAddress(addr), addr)
+		}
+
+		for _, addr := range []string{"12345", "localhost", ":http", ":70000"} {
+			assert.Error(t, validateAddress(addr), addr)
+		}
+	})
+
+	t.Run("redirect uri", func(t *testing.T) {
+		t.Parallel()
+
+		for _, uri := range []string{"http://localhost:7979", "https://nesthub.local:8443/callback"} {
+			assert.NoError(t, validateRedirectURI(uri), uri)
+		}
+
+		for _, uri := range []string{"localhost:7979", "http://localhost", "http://:7979", "ftp://localhost:21"} {
+			assert.Error(t, validateRedirectURI(uri), uri)
+		}
 	})
 }
@@ -0,0 +1,57 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+)
+
+const envPrefix = "NESTHUB_"
+
+// applyEnvOverrides overrides config fields from the environment. A field is
+// set by NESTHUB_<env tag>, and a field tagged secret alternatively by the file
+// named by NESTHUB_<env tag>_FILE, e.g. a mounted secret. Setting both is an
+// error, as one would silently shadow the other. Fields holding paths are not
+// tagged secret, as the file would be read into the path. The environment
+// takes precedence over the config file, which takes precedence over the
+// default of an optional field.
+func (cfg *Config) applyEnvOverrides(lookup func(string) (string, bool)) error {
+	v := reflect.ValueOf(cfg).Elem()
+	t := v.Type()
+
+	for i := 0; i < t.NumField(); i++ {
+		tag, opt, _ := strings.Cut(t.Field(i).Tag.Get("env"), ",")
+		if tag == "" {
+			continue
+		}
+
+		name := envPrefix + tag
+		value, ok := lookup(name)
+		path, fileOK := lookup(name + "_FILE")
+
+		if fileOK && opt != "secret" {
+			return fmt.Errorf("%s_FILE is not supported, %s does not hold a secret", name, t.Field(i).Name)
+		}
+
+		if ok && fileOK {
+			return fmt.Errorf("both %s and %s_FILE are set", name, name)
+		}
+
+		if fileOK {
+			b, err := os.ReadFile(path)
+			if err != nil {
+				return fmt.Errorf("failed to read %s_FILE: %w", name, err)
+			}
+
+			// files written by editors and secret managers often end in a newline
+			value, ok = strings.TrimRight(string(b), "\r\n"), true
+		}
+
+		if ok {
+			v.Field(i).SetString(value)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,97 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func mapLookup(env map[string]string) func(string) (string, bool) {
+	return func(name string) (string, bool) {
+		v, ok := env[name]
+		return v, ok
+	}
+}
+
+func TestApplyEnvOverrides(t *testing.T) {
+	t.Parallel()
+
+	t.Run("every field has an env tag", func(t *testing.T) {
+		t.Parallel()
+
+		typ := reflect.TypeOf(Config{})
+		for i := 0; i < typ.NumField(); i++ {
+			assert.NotEmpty(t, typ.Field(i).Tag.Get("env"), typ.Field(i).Name)
+		}
+	})
+
+	t.Run("no overrides", func(t *testing.T) {
+		t.Parallel()
+		tempConfig := newTestConfig()
+		require.NoError(t, tempConfig.applyEnvOverrides(mapLookup(nil)))
+		assert.Equal(t, newTestConfig(), tempConfig)
+	})
+
+	t.Run("variable overrides file", func(t *testing.T) {
+		t.Parallel()
+		tempConfig := newTestConfig()
+		require.NoError(t, tempConfig.applyEnvOverrides(mapLookup(map[string]string{
+			"NESTHUB_HUB_NAME":    "your",
+			"NESTHUB_OAUTH_TOKEN": "/run/token.json",
+		})))
+		assert.Equal(t, "your", tempConfig.HubName)
+		assert.Equal(t, "/run/token.json", tempConfig.OAuthTokenPath)
+		assert.Equal(t, "guitar", tempConfig.SDMProjectID)
+	})
+
+	t.Run("empty variable clears the field", func(t *testing.T) {
+		t.Parallel()
+		tempConfig := newTestConfig()
+		require.NoError(t, tempConfig.applyEnvOverrides(mapLookup(map[string]string{
+			"NESTHUB_ADDRESS": "",
+		})))
+		assert.Equal(t, "", tempConfig.Address)
+	})
+
+	t.Run("secret file", func(t *testing.T) {
+		t.Parallel()
+		path := filepath.Join(t.TempDir(), "secret")
+		require.NoError(t, os.WriteFile(path, []byte("s3cret\n"), 0o600))
+
+		tempConfig := newTestConfig()
+		require.NoError(t, tempConfig.applyEnvOverrides(mapLookup(map[string]string{
+			"NESTHUB_OAUTH_CLIENT_SECRET_FILE": path,
+		})))
+		assert.Equal(t, "s3cret", tempConfig.OAuthClientSecret)
+	})
+
+	t.Run("file of a path field", func(t *testing.T) {
+		t.Parallel()
+		tempConfig := newTestConfig()
+		assert.Error(t, tempConfig.applyEnvOverrides(mapLookup(map[string]string{
+			"NESTHUB_SERVICE_ACCOUNT_KEY_FILE": "/run/secrets/key.json",
+		})))
+		assert.Equal(t, "here", tempConfig.ServiceAccountKey)
+	})
+
+	t.Run("missing secret file", func(t *testing.T) {
+		t.Parallel()
+		tempConfig := newTestConfig()
+		assert.Error(t, tempConfig.applyEnvOverrides(mapLookup(map[string]string{
+			"NESTHUB_OAUTH_CLIENT_SECRET_FILE": filepath.Join(t.TempDir(), "missing"),
+		})))
+	})
+
+	t.Run("variable and file both set", func(t *testing.T) {
+		t.Parallel()
+		tempConfig := newTestConfig()
+		assert.Error(t, tempConfig.applyEnvOverrides(mapLookup(map[string]string{
+			"NESTHUB_OAUTH_CLIENT_SECRET":      "hey",
+			"NESTHUB_OAUTH_CLIENT_SECRET_FILE": "/run/secret",
+		})))
+	})
+}
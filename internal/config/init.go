@@ -0,0 +1,135 @@
+package config
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Init prompts for the fields that can't be defaulted and writes a new config
+// file to path. An existing file is never overwritten.
+func Init(path string, in io.Reader, out io.Writer) error {
+	if _, err := os.Stat(path); err == nil {
+		return fmt.Errorf("config file %s already exists", path)
+	}
+
+	dir, err := filepath.Abs(filepath.Dir(path))
+	if err != nil {
+		return fmt.Errorf("failed to resolve config directory: %w", err)
+	}
+
+	pairingCode, err := NewPairingCode()
+	if err != nil {
+		return err
+	}
+
+	p := &prompter{scanner: bufio.NewScanner(in), out: out}
+	cfg := &Config{
+		HubName:          "Nesthub",
+		PairingCode:      pairingCode,
+		StoragePath:      filepath.Join(dir, "data"),
+		SetupRedirectUri: "http://localhost:7979",
+	}
+
+	fields := []struct {
+		prompt string
+		value  *string
+		def    string
+	}{
+		{"SDM project ID (Device Access Console)", &cfg.SDMProjectID, ""},
+		{"GCP project ID (Google Cloud Console)", &cfg.GCPProjectID, ""},
+		{"OAuth client ID", &cfg.OAuthClientID, ""},
+		{"OAuth client secret", &cfg.OAuthClientSecret, ""},
+		{"Service account key path", &cfg.ServiceAccountKey, ""},
+		{"OAuth token path", &cfg.OAuthTokenPath, filepath.Join(dir, "oauth_token.json")},
+	}
+
+	for _, f := range fields {
+		v, err := p.ask(f.prompt, f.def)
+		if err != nil {
+			return err
+		}
+
+		*f.value = v
+	}
+
+	if err := cfg.validateRequiredFields(); err != nil {
+		return fmt.Errorf("invalid config: %w", err)
+	}
+
+	b, err := json.MarshalIndent(cfg, "", "    ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal config: %w", err)
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to create config file %s: %w", path, err)
+	}
+
+	defer file.Close()
+
+	if _, err := file.Write(append(b, '\n')); err != nil {
+		return fmt.Errorf("failed to write config file %s: %w", path, err)
+	}
+
+	fmt.Fprintf(out, "Config written to %s, the HomeKit pairing code is %s\n", path, cfg.PairingCode)
+
+	return nil
+}
+
+// prompter asks for config values on a terminal
+type prompter struct {
+	scanner *bufio.Scanner
+	out     io.Writer
+}
+
+// ask prompts until a non-empty value is entered, or returns def on empty
+// input if it is set
+func (p *prompter) ask(prompt, def string) (string, error) {
+	for {
+		if def != "" {
+			fmt.Fprintf(p.out, "%s [%s]: ", prompt, def)
+		} else {
+			fmt.Fprintf(p.out, "%s: ", prompt)
+		}
+
+		if !p.scanner.Scan() {
+			if err := p.scanner.Err(); err != nil {
+				return "", fmt.Errorf("failed to read %s: %w", prompt, err)
+			}
+
+			return "", fmt.Errorf("no value entered for %s", prompt)
+		}
+
+		v := strings.TrimSpace(p.scanner.Text())
+		if v != "" {
+			return v, nil
+		}
+
+		if def != "" {
+			return def, nil
+		}
+	}
+}
+
+// NewPairingCode returns a random 8 digit HomeKit pairing code
+func NewPairingCode() (string, error) {
+	for {
+		n, err := rand.Int(rand.Reader, big.NewInt(100_000_000))
+		if err != nil {
+			return "", fmt.Errorf("failed to generate pairing code: %w", err)
+		}
+
+		code := fmt.Sprintf("%08d", n.Int64())
+		if err := validatePairingCode(code); err == nil {
+			return code, nil
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package config
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInit(t *testing.T) {
+	t.Parallel()
+
+	t.Run("writes a loadable config", func(t *testing.T) {
+		t.Parallel()
+
+		path := filepath.Join(t.TempDir(), "config.json")
+		keyPath := filepath.Join(filepath.Dir(path), "key.json")
+		require.NoError(t, os.WriteFile(keyPath, []byte("{}"), 0o600))
+
+		// the empty line re-prompts for the SDM project ID, the last one accepts the token path default
+		in := strings.NewReader("\nsdm-project\ngcp-project\nclient-id\nclient-secret\n" + keyPath + "\n\n")
+
+		require.NoError(t, Init(path, in, io.Discard))
+
+		info, err := os.Stat(path)
+		require.NoError(t, err)
+		assert.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+
+		cfg, err := NewConfig(path)
+		require.NoError(t, err)
+		assert.Equal(t, "sdm-project", cfg.SDMProjectID)
+		assert.Equal(t, keyPath, cfg.ServiceAccountKey)
+		assert.Equal(t, filepath.Join(filepath.Dir(path), "oauth_token.json"), cfg.OAuthTokenPath)
+		assert.Equal(t, filepath.Join(filepath.Dir(path), "data"), cfg.StoragePath)
+		assert.NoError(t, validatePairingCode(cfg.PairingCode))
+	})
+
+	t.Run("refuses to overwrite", func(t *testing.T) {
+		t.Parallel()
+
+		path := filepath.Join(t.TempDir(), "config.json")
+		require.NoError(t, os.WriteFile(path, []byte("{}"), 0o600))
+
+		assert.Error(t, Init(path, strings.NewReader(""), io.Discard))
+	})
+
+	t.Run("missing input", func(t *testing.T) {
+		t.Parallel()
+
+		path := filepath.Join(t.TempDir(), "config.json")
+		assert.Error(t, Init(path, strings.NewReader("sdm-project\n"), io.Discard))
+
+		_, err := os.Stat(path)
+		assert.True(t, os.IsNotExist(err))
+	})
+}
+
+func TestValidatePairingCode(t *testing.T) {
+	t.Parallel()
+
+	for _, code := range []string{"1234567", "1234567a", "00000000", "33333333", "12345678", "87654321"} {
+		assert.Error(t, validatePairingCode(code), code)
+	}
+
+	assert.NoError(t, validatePairingCode("77887788"))
+
+	code, err := NewPairingCode()
+	require.NoError(t, err)
+	assert.NoError(t, validatePairingCode(code))
+}
@@ -3,8 +3,12 @@ package config
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"log"
 	"os"
+	"path/filepath"
+	"sync"
 
 	"github.com/yangl1996/nesthub/internal/helpers"
 	"golang.org/x/oauth2"
@@ -18,25 +22,115 @@ func (cfg *Config) NewOAuthTokenSource(ctx context.Context) (oauth2.TokenSource,
 
 	tokenCfg := cfg.getOAuthConfig()
 
-	return tokenCfg.TokenSource(ctx, token), nil
+	return &persistingTokenSource{
+		src:  tokenCfg.TokenSource(ctx, token),
+		path: cfg.OAuthTokenPath,
+		last: token,
+	}, nil
 }
 
-func (cfg *Config) WriteOAuthTokenToFile(authCode, path string) error {
+// RefreshOAuthToken refreshes the oauth token regardless of its expiry, which
+// verifies that the refresh token is still accepted
+func (cfg *Config) RefreshOAuthToken(ctx context.Context) error {
+	token := &oauth2.Token{}
+	if err := helpers.JsonUnmarshalFile(cfg.OAuthTokenPath, token); err != nil {
+		return fmt.Errorf("failed to load oauth token: %w", err)
+	}
+
+	if token.RefreshToken == "" {
+		return errors.New("oauth token has no refresh token")
+	}
+
+	tokenCfg := cfg.getOAuthConfig()
+	ts := &persistingTokenSource{
+		src:  tokenCfg.TokenSource(ctx, &oauth2.Token{RefreshToken: token.RefreshToken}),
+		path: cfg.OAuthTokenPath,
+		last: token,
+	}
+
+	if _, err := ts.Token(); err != nil {
+		return fmt.Errorf("failed to refresh oauth token: %w", err)
+	}
+
+	return nil
+}
+
+// persistingTokenSource writes the token back to the token file whenever it is
+// refreshed, so that a restart picks up the latest access and refresh tokens.
+type persistingTokenSource struct {
+	sync.Mutex
+	src  oauth2.TokenSource
+	path string
+	last *oauth2.Token
+}
+
+func (s *persistingTokenSource) Token() (*oauth2.Token, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	token, err := s.src.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	if s.last != nil && token.AccessToken == s.last.AccessToken && token.RefreshToken == s.last.RefreshToken {
+		return token, nil
+	}
+
+	// a failed write only costs a refresh after the next restart
+	if err := writeTokenFile(s.path, token); err != nil {
+		log.Printf("Failed to persist refreshed oauth token: %v", err)
+		return token, nil
+	}
+
+	s.last = token
+
+	return token, nil
+}
+
+func (cfg *Config) WriteOAuthTokenToFile(ctx context.Context, authCode, path string) error {
 	oauthConfig := cfg.getOAuthConfig()
-	ctx := context.Background()
 
 	token, err := oauthConfig.Exchange(ctx, authCode)
 	if err != nil {
 		return fmt.Errorf("failed to convert authorization code into a token: %w", err)
 	}
 
+	return writeTokenFile(cfg.OAuthTokenPath, token)
+}
+
+// writeTokenFile atomically replaces the token file, so that a crash never
+// leaves a truncated token behind
+func writeTokenFile(path string, token *oauth2.Token) error {
 	tokenJson, err := json.Marshal(token)
 	if err != nil {
 		return fmt.Errorf("failed to marshal token: %w", err)
 	}
 
-	if err := os.WriteFile(cfg.OAuthTokenPath, tokenJson, 0o600); err != nil {
-		return fmt.Errorf("failed to write token to file %s: %w", cfg.OAuthTokenPath, err)
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary token file: %w", err)
+	}
+
+	defer os.Remove(tmp.Name()) //nolint:errcheck
+
+	// CreateTemp already uses 0600, make sure of it regardless of the platform
+	if err := tmp.Chmod(0o600); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to set permissions of temporary token file: %w", err)
+	}
+
+	if _, err := tmp.Write(tokenJson); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write token to file %s: %w", tmp.Name(), err)
+	}
+
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write token to file %s: %w", tmp.Name(), err)
+	}
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to write token to file %s: %w", path, err)
 	}
 
 	return nil
@@ -0,0 +1,80 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/yangl1996/nesthub/internal/helpers"
+	"golang.org/x/oauth2"
+)
+
+// sequenceTokenSource returns the given tokens in order, repeating the last one
+type sequenceTokenSource []*oauth2.Token
+
+func (s *sequenceTokenSource) Token() (*oauth2.Token, error) {
+	t := (*s)[0]
+	if len(*s) > 1 {
+		*s = (*s)[1:]
+	}
+
+	return t, nil
+}
+
+func TestPersistingTokenSource(t *testing.T) {
+	t.Parallel()
+
+	t.Run("unchanged token is not written", func(t *testing.T) {
+		t.Parallel()
+
+		path := filepath.Join(t.TempDir(), "token.json")
+		token := &oauth2.Token{AccessToken: "a", RefreshToken: "r"}
+
+		ts := &persistingTokenSource{
+			src:  &sequenceTokenSource{token},
+			path: path,
+			last: token,
+		}
+
+		_, err := ts.Token()
+		require.NoError(t, err)
+
+		_, err = os.Stat(path)
+		assert.True(t, os.IsNotExist(err))
+	})
+
+	t.Run("refreshed token is written", func(t *testing.T) {
+		t.Parallel()
+
+		path := filepath.Join(t.TempDir(), "token.json")
+
+		ts := &persistingTokenSource{
+			src: &sequenceTokenSource{
+				{AccessToken: "b", RefreshToken: "r"},
+				{AccessToken: "c", RefreshToken: "s"},
+			},
+			path: path,
+			last: &oauth2.Token{AccessToken: "a", RefreshToken: "r"},
+		}
+
+		for _, want := range []string{"b", "c"} {
+			_, err := ts.Token()
+			require.NoError(t, err)
+
+			written := &oauth2.Token{}
+			require.NoError(t, helpers.JsonUnmarshalFile(path, written))
+			assert.Equal(t, want, written.AccessToken)
+		}
+
+		info, err := os.Stat(path)
+		require.NoError(t, err)
+		assert.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+
+		// no temporary files are left behind
+		entries, err := os.ReadDir(filepath.Dir(path))
+		require.NoError(t, err)
+		assert.Len(t, entries, 1)
+	})
+}
@@ -0,0 +1,50 @@
+package config
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"cloud.google.com/go/pubsub"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// NewPubsubClient returns a pubsub client of the GCP project, authenticated as
+// the service account. When a pubsub emulator is configured the client
+// connects to it without credentials instead.
+func (cfg *Config) NewPubsubClient(ctx context.Context) (*pubsub.Client, error) {
+	if !cfg.PubsubEmulated() {
+		return pubsub.NewClient(ctx, cfg.GCPProjectID, option.WithCredentialsFile(cfg.ServiceAccountKey))
+	}
+
+	host := cfg.pubsubEmulatorHost()
+
+	c, err := pubsub.NewClient(ctx, cfg.GCPProjectID,
+		option.WithEndpoint(host),
+		option.WithoutAuthentication(),
+		option.WithGRPCDialOption(grpc.WithTransportCredentials(insecure.NewCredentials())),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to pubsub emulator %s: %w", host, err)
+	}
+
+	return c, nil
+}
+
+// PubsubEmulated returns true if a pubsub emulator is used instead of Google
+// Cloud, which needs no service account
+func (cfg *Config) PubsubEmulated() bool {
+	return cfg.pubsubEmulatorHost() != ""
+}
+
+// pubsubEmulatorHost returns the address of the pubsub emulator, or "" when
+// Google Cloud is used
+func (cfg *Config) pubsubEmulatorHost() string {
+	if cfg.PubsubEmulatorHost != "" {
+		return cfg.PubsubEmulatorHost
+	}
+
+	return os.Getenv("PUBSUB_EMULATOR_HOST")
+}
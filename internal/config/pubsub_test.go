@@ -0,0 +1,59 @@
+package config
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeEmulatorConfig writes a config without a service account key and
+// returns its path
+func writeEmulatorConfig(t *testing.T, emulatorHost string) string {
+	t.Helper()
+
+	dir := t.TempDir()
+
+	tempConfig := newTestConfig()
+	tempConfig.ServiceAccountKey = ""
+	tempConfig.OAuthTokenPath = filepath.Join(dir, "token.json")
+	tempConfig.StoragePath = filepath.Join(dir, "data")
+	tempConfig.PubsubEmulatorHost = emulatorHost
+
+	b, err := json.Marshal(tempConfig)
+	require.NoError(t, err)
+
+	path := filepath.Join(dir, "config.json")
+	require.NoError(t, os.WriteFile(path, b, 0o600))
+
+	return path
+}
+
+func TestPubsubEmulatorConfig(t *testing.T) {
+	t.Run("emulator host in the config", func(t *testing.T) {
+		cfg, err := NewConfig(writeEmulatorConfig(t, "localhost:8085"))
+		require.NoError(t, err)
+
+		assert.True(t, cfg.PubsubEmulated())
+		assert.Empty(t, cfg.ServiceAccountKey)
+	})
+
+	t.Run("emulator host in the environment", func(t *testing.T) {
+		t.Setenv("PUBSUB_EMULATOR_HOST", "localhost:8085")
+
+		cfg, err := NewConfig(writeEmulatorConfig(t, ""))
+		require.NoError(t, err)
+
+		assert.True(t, cfg.PubsubEmulated())
+	})
+
+	t.Run("service account key required without an emulator", func(t *testing.T) {
+		t.Setenv("PUBSUB_EMULATOR_HOST", "")
+
+		_, err := NewConfig(writeEmulatorConfig(t, ""))
+		assert.ErrorIs(t, err, ErrRequired)
+	})
+}
@@ -0,0 +1,68 @@
+package config
+
+import (
+	"reflect"
+	"strings"
+)
+
+// Reload reads the config file at path again and returns a copy of cfg with
+// the fields that can be applied while running taken from it. The other
+// fields keep their current value, the names of those that changed are
+// returned so that the caller can tell the user to restart nesthub.
+//
+// The file is validated like on start, an invalid file leaves cfg untouched.
+func (cfg *Config) Reload(path string) (*Config, []string, error) {
+	loaded, err := NewConfig(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	next, refused := cfg.merge(loaded)
+
+	return next, refused, nil
+}
+
+// merge copies the live fields of loaded into a copy of cfg and returns the
+// names of the changed fields that need a restart
+func (cfg *Config) merge(loaded *Config) (*Config, []string) {
+	// live fields are read by the running emulation whenever they are used,
+	// the others are baked into the HAP server, the oauth token source or the
+	// pubsub subscription on start. HubName is among the latter, as hap only
+	// announces the name over mDNS when the server starts.
+	live := map[string]bool{
+		"FanDuration":    true,
+		"SensorHoldTime": true,
+	}
+
+	next := *cfg
+	refused := []string{}
+
+	cur := reflect.ValueOf(&next).Elem()
+	src := reflect.ValueOf(loaded).Elem()
+
+	for i := 0; i < cur.NumField(); i++ {
+		field := cur.Type().Field(i)
+		if cur.Field(i).Interface() == src.Field(i).Interface() {
+			continue
+		}
+
+		if !live[field.Name] {
+			refused = append(refused, jsonName(field))
+			continue
+		}
+
+		cur.Field(i).Set(src.Field(i))
+	}
+
+	return &next, refused
+}
+
+// jsonName returns the name of the field in the config file
+func jsonName(field reflect.StructField) string {
+	name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+	if name == "" {
+		return field.Name
+	}
+
+	return name
+}
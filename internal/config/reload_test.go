@@ -0,0 +1,100 @@
+package config
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMerge(t *testing.T) {
+	t.Parallel()
+
+	t.Run("unchanged", func(t *testing.T) {
+		t.Parallel()
+		tempConfig := newTestConfig()
+		loaded := newTestConfig()
+
+		next, refused := tempConfig.merge(&loaded)
+		assert.Equal(t, tempConfig, *next)
+		assert.Empty(t, refused)
+	})
+
+	t.Run("live fields are applied", func(t *testing.T) {
+		t.Parallel()
+		tempConfig := newTestConfig()
+		loaded := newTestConfig()
+		loaded.FanDuration = "30m"
+		loaded.SensorHoldTime = "10s"
+
+		next, refused := tempConfig.merge(&loaded)
+		assert.Equal(t, loaded, *next)
+		assert.Empty(t, refused)
+		assert.Equal(t, "15m", tempConfig.FanDuration, "the current config must not change")
+	})
+
+	t.Run("restart fields are refused", func(t *testing.T) {
+		t.Parallel()
+		tempConfig := newTestConfig()
+		loaded := newTestConfig()
+		loaded.HubName = "your"
+		loaded.PairingCode = "31415926"
+		loaded.StoragePath = "/var/lib/nesthub"
+		loaded.OAuthTokenPath = "/var/lib/nesthub/token.json"
+
+		next, refused := tempConfig.merge(&loaded)
+		assert.Equal(t, tempConfig.HubName, next.HubName)
+		assert.Equal(t, tempConfig.PairingCode, next.PairingCode)
+		assert.Equal(t, tempConfig.StoragePath, next.StoragePath)
+		assert.Equal(t, tempConfig.OAuthTokenPath, next.OAuthTokenPath)
+		assert.Equal(t, []string{"HubName", "OAuthToken", "PairingCode", "StoragePath"}, refused)
+	})
+}
+
+func TestReload(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	key := filepath.Join(dir, "key.json")
+	require.NoError(t, os.WriteFile(key, []byte("{}"), 0o600))
+
+	tempConfig := newTestConfig()
+	tempConfig.ServiceAccountKey = key
+	tempConfig.OAuthTokenPath = filepath.Join(dir, "token.json")
+	tempConfig.StoragePath = filepath.Join(dir, "data")
+
+	write := func(t *testing.T, cfg Config) string {
+		t.Helper()
+
+		b, err := json.Marshal(cfg)
+		require.NoError(t, err)
+
+		path := filepath.Join(t.TempDir(), "config.json")
+		require.NoError(t, os.WriteFile(path, b, 0o600))
+
+		return path
+	}
+
+	t.Run("valid", func(t *testing.T) {
+		t.Parallel()
+		loaded := tempConfig
+		loaded.FanDuration = "2h"
+
+		next, refused, err := tempConfig.Reload(write(t, loaded))
+		require.NoError(t, err)
+		assert.Equal(t, "2h", next.FanDuration)
+		assert.Empty(t, refused)
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		t.Parallel()
+		loaded := tempConfig
+		loaded.FanDuration = "forever"
+
+		_, _, err := tempConfig.Reload(write(t, loaded))
+		assert.Error(t, err)
+	})
+}
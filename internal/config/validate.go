@@ -0,0 +1,207 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/brutella/hap"
+)
+
+var ErrRequired error = errors.New("is required")
+
+// FieldError describes why the value of a config field is invalid
+type FieldError struct {
+	// Field is the name of the field in the config file
+	Field string
+
+	Err error
+}
+
+func (e *FieldError) Error() string {
+	return fmt.Sprintf("%s %s", e.Field, e.Err.Error())
+}
+
+func (e *FieldError) Unwrap() error {
+	return e.Err
+}
+
+// invalidFields checks the values of the fields that are set. Missing fields
+// are reported by missingFields.
+func (cfg *Config) invalidFields() []error {
+	errs := []error{}
+
+	check := func(field, value string, validate func(string) error) {
+		if value == "" {
+			return
+		}
+
+		if err := validate(value); err != nil {
+			errs = append(errs, &FieldError{Field: field, Err: err})
+		}
+	}
+
+	check("PairingCode", cfg.PairingCode, validatePairingCode)
+	check("Address", cfg.Address, validateAddress)
+	check("SetupRedirectUri", cfg.SetupRedirectUri, validateRedirectURI)
+	check("SetupTimeout", cfg.SetupTimeout, durationBetween(time.Second, 24*time.Hour))
+	// SDM accepts fan timers between 1 second and 12 hours
+	check("FanDuration", cfg.FanDuration, durationBetween(time.Second, 12*time.Hour))
+	check("SensorHoldTime", cfg.SensorHoldTime, durationBetween(time.Second, 24*time.Hour))
+	// polls share a budget of a few requests per minute with the commands of
+	// all devices
+	check("PollInterval", cfg.PollInterval, durationBetween(time.Minute, 24*time.Hour))
+	check("PubsubEmulatorHost", cfg.PubsubEmulatorHost, validateAddress)
+
+	return errs
+}
+
+// invalidPaths checks that the files nesthub reads exist and that the files it
+// writes can be created. Nothing is created here.
+func (cfg *Config) invalidPaths() []error {
+	errs := []error{}
+
+	check := func(field, value string, validate func(string) error) {
+		if value == "" {
+			return
+		}
+
+		if err := validate(value); err != nil {
+			errs = append(errs, &FieldError{Field: field, Err: err})
+		}
+	}
+
+	if !cfg.PubsubEmulated() {
+		check("ServiceAccountKey", cfg.ServiceAccountKey, validateExistingFile)
+	}
+
+	check("OAuthToken", cfg.OAuthTokenPath, validateCreatableFile)
+	check("StoragePath", cfg.StoragePath, validateCreatableDir)
+
+	return errs
+}
+
+// validatePairingCode checks that code is 8 digits and not one of the trivial
+// codes HomeKit refuses
+func validatePairingCode(code string) error {
+	if len(code) != 8 || strings.Trim(code, "0123456789") != "" {
+		return errors.New("must be 8 digits")
+	}
+
+	if hap.InvalidPins[code] {
+		return errors.New("is too trivial for HomeKit")
+	}
+
+	return nil
+}
+
+func validateAddress(addr string) error {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return errors.New("must be host:port")
+	}
+
+	if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		return fmt.Errorf("has invalid port %q", port)
+	}
+
+	return nil
+}
+
+func validateRedirectURI(uri string) error {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return errors.New("must be a URL")
+	}
+
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return errors.New("must be an http or https URL")
+	}
+
+	if u.Hostname() == "" {
+		return errors.New("must have a host")
+	}
+
+	// the port is where the setup server listens for the callback
+	if n, err := strconv.ParseUint(u.Port(), 10, 16); err != nil || n == 0 {
+		return errors.New("must have a port")
+	}
+
+	return nil
+}
+
+func durationBetween(min, max time.Duration) func(string) error {
+	return func(s string) error {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return errors.New("must be a duration like 30s or 15m")
+		}
+
+		if d < min || d > max {
+			return fmt.Errorf("must be between %s and %s", min, max)
+		}
+
+		return nil
+	}
+}
+
+func validateExistingFile(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return errors.New("does not exist")
+	}
+
+	if info.IsDir() {
+		return errors.New("is a directory")
+	}
+
+	return nil
+}
+
+func validateCreatableFile(path string) error {
+	info, err := os.Stat(path)
+	if err == nil {
+		if info.IsDir() {
+			return errors.New("is a directory")
+		}
+
+		return nil
+	}
+
+	if info, err := os.Stat(filepath.Dir(path)); err != nil || !info.IsDir() {
+		return fmt.Errorf("cannot be created, directory %s does not exist", filepath.Dir(path))
+	}
+
+	return nil
+}
+
+func validateCreatableDir(path string) error {
+	_, err := CreatableDir(path)
+	return err
+}
+
+// CreatableDir returns the closest existing ancestor of the directory path, or
+// path itself if it exists. Missing parents are created along with path, so
+// the ancestor has to be a directory. Nothing is created here.
+func CreatableDir(path string) (string, error) {
+	for p := filepath.Clean(path); ; p = filepath.Dir(p) {
+		info, err := os.Stat(p)
+		if err == nil {
+			if !info.IsDir() {
+				return "", fmt.Errorf("cannot be created, %s is not a directory", p)
+			}
+
+			return p, nil
+		}
+
+		if filepath.Dir(p) == p {
+			return "", errors.New("cannot be created")
+		}
+	}
+}
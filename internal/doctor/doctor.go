@@ -0,0 +1,196 @@
+package doctor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/yangl1996/nesthub/internal/config"
+	"github.com/yangl1996/nesthub/internal/onboard"
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/option"
+	sdm "google.golang.org/api/smartdevicemanagement/v1"
+)
+
+const sdmSvcName = "smartdevicemanagement.googleapis.com"
+
+// check is a single prerequisite of nesthub
+type check struct {
+	// name is printed with the outcome of the check
+	name string
+
+	// hint tells the user how to fix a failed check
+	hint string
+
+	// requires lists the checks that must pass for this check to be meaningful
+	requires []string
+
+	run func(ctx context.Context, cfg *config.Config) error
+}
+
+// Run checks each prerequisite of nesthub in turn and prints the outcome to
+// out. It returns true if all checks passed.
+func Run(ctx context.Context, configPath string, out io.Writer) bool {
+	// the paths are checked by the checks below, with hints
+	cfg, err := config.LoadConfig(configPath)
+	if err != nil {
+		report(out, "config fields", err, fmt.Sprintf("fix %s, see the example config in the README", configPath))
+		return false
+	}
+
+	report(out, "config fields", nil, "")
+
+	return run(ctx, cfg, out, checks())
+}
+
+func checks() []check {
+	return []check{
+		{
+			name: "service account key",
+			hint: "download a JSON key of the service account and set ServiceAccountKey to its path (README step 5)",
+			run:  checkServiceAccountKey,
+		},
+		{
+			name:     "SDM API enabled",
+			hint:     "run nesthub once to enable the API, or enable " + sdmSvcName + " in the GCP console",
+			requires: []string{"service account key"},
+			run: func(ctx context.Context, cfg *config.Config) error {
+				return onboard.SvcEnabled(ctx, cfg, sdmSvcName)
+			},
+		},
+		{
+			name: "OAuth token refresh",
+			hint: "delete the token file and run nesthub (or nesthub -setup-headless) to authorize again",
+			run: func(ctx context.Context, cfg *config.Config) error {
+				return cfg.RefreshOAuthToken(ctx)
+			},
+		},
+		{
+			name:     "enterprise device list",
+			hint:     "check SDMProjectID and that the devices are shared with the SDM project in the partner connections manager",
+			requires: []string{"SDM API enabled", "OAuth token refresh"},
+			run:      checkDeviceList,
+		},
+		{
+			name:     "pubsub subscription exists",
+			hint:     "run nesthub once to create it, or check PubsubSubscription and GCPProjectID",
+			requires: []string{"service account key"},
+			run:      onboard.SubscriptionExists,
+		},
+		{
+			name:     "pubsub subscription IAM",
+			hint:     "grant the service account the Pub/Sub Subscriber role on the subscription",
+			requires: []string{"pubsub subscription exists"},
+			run:      onboard.SubscriptionConsumable,
+		},
+		{
+			name: "HAP storage path writable",
+			hint: "set StoragePath to a directory nesthub may create files in",
+			run:  checkStoragePath,
+		},
+	}
+}
+
+// run executes the checks in order. Checks whose requirements failed are
+// skipped.
+func run(ctx context.Context, cfg *config.Config, out io.Writer, cs []check) bool {
+	passed := map[string]bool{}
+	ok := true
+
+	for _, c := range cs {
+		if missing := missingRequirement(c, passed); missing != "" {
+			fmt.Fprintf(out, "SKIP %s: requires %s\n", c.name, missing)
+			ok = false
+
+			continue
+		}
+
+		err := c.run(ctx, cfg)
+		report(out, c.name, err, c.hint)
+
+		passed[c.name] = err == nil
+		ok = ok && err == nil
+	}
+
+	return ok
+}
+
+func missingRequirement(c check, passed map[string]bool) string {
+	for _, r := range c.requires {
+		if !passed[r] {
+			return r
+		}
+	}
+
+	return ""
+}
+
+func report(out io.Writer, name string, err error, hint string) {
+	if err == nil {
+		fmt.Fprintf(out, "PASS %s\n", name)
+		return
+	}
+
+	fmt.Fprintf(out, "FAIL %s: %v\n     hint: %s\n", name, err, hint)
+}
+
+func checkServiceAccountKey(_ context.Context, cfg *config.Config) error {
+	b, err := os.ReadFile(cfg.ServiceAccountKey)
+	if err != nil {
+		return fmt.Errorf("failed to read service account key: %w", err)
+	}
+
+	if _, err := google.JWTConfigFromJSON(b); err != nil {
+		return fmt.Errorf("failed to parse service account key: %w", err)
+	}
+
+	return nil
+}
+
+func checkDeviceList(ctx context.Context, cfg *config.Config) error {
+	tokenSource, err := cfg.NewOAuthTokenSource(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get oauth token source: %w", err)
+	}
+
+	s, err := sdm.NewService(ctx, option.WithTokenSource(tokenSource))
+	if err != nil {
+		return fmt.Errorf("failed to create sdm service: %w", err)
+	}
+
+	resp, err := s.Enterprises.Devices.List("enterprises/" + cfg.SDMProjectID).Context(ctx).Do()
+	if err != nil {
+		return fmt.Errorf("failed to list devices: %w", err)
+	}
+
+	if len(resp.Devices) == 0 {
+		return errors.New("no devices are shared with the SDM project")
+	}
+
+	return nil
+}
+
+// checkStoragePath checks that nesthub can write to the storage path, or
+// create it, without creating it
+func checkStoragePath(_ context.Context, cfg *config.Config) error {
+	if cfg.StoragePath == "" {
+		return errors.New("StoragePath is not set")
+	}
+
+	dir, err := config.CreatableDir(cfg.StoragePath)
+	if err != nil {
+		return fmt.Errorf("storage path %w", err)
+	}
+
+	f, err := os.CreateTemp(dir, ".doctor-*")
+	if err != nil {
+		return fmt.Errorf("failed to write to %s: %w", dir, err)
+	}
+
+	f.Close()
+
+	return os.Remove(filepath.Clean(f.Name()))
+}
@@ -0,0 +1,118 @@
+package doctor
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/yangl1996/nesthub/internal/config"
+)
+
+func TestRun(t *testing.T) {
+	t.Parallel()
+
+	pass := func(context.Context, *config.Config) error { return nil }
+	fail := func(context.Context, *config.Config) error { return errors.New("boom") }
+
+	t.Run("all pass", func(t *testing.T) {
+		t.Parallel()
+
+		out := &bytes.Buffer{}
+		ok := run(context.Background(), &config.Config{}, out, []check{
+			{name: "a", run: pass},
+			{name: "b", requires: []string{"a"}, run: pass},
+		})
+
+		assert.True(t, ok)
+		assert.Equal(t, "PASS a\nPASS b\n", out.String())
+	})
+
+	t.Run("failure skips dependent checks only", func(t *testing.T) {
+		t.Parallel()
+
+		out := &bytes.Buffer{}
+		ok := run(context.Background(), &config.Config{}, out, []check{
+			{name: "a", hint: "fix a", run: fail},
+			{name: "b", requires: []string{"a"}, run: pass},
+			{name: "c", run: pass},
+		})
+
+		assert.False(t, ok)
+		assert.Equal(t, "FAIL a: boom\n     hint: fix a\nSKIP b: requires a\nPASS c\n", out.String())
+	})
+}
+
+func TestRunReportsPaths(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	file := filepath.Join(dir, "file")
+	require.NoError(t, os.WriteFile(file, nil, 0o600))
+
+	b, err := json.Marshal(config.Config{
+		HubName:           "Nest",
+		SDMProjectID:      "sdm",
+		GCPProjectID:      "gcp",
+		OAuthClientID:     "id",
+		OAuthClientSecret: "secret",
+		OAuthTokenPath:    filepath.Join(dir, "token.json"),
+		ServiceAccountKey: filepath.Join(dir, "missing.json"),
+		PairingCode:       "77887788",
+		StoragePath:       filepath.Join(file, "data"),
+	})
+	require.NoError(t, err)
+
+	path := filepath.Join(dir, "config.json")
+	require.NoError(t, os.WriteFile(path, b, 0o600))
+
+	// the paths are reported by their own checks, with their hints
+	out := &bytes.Buffer{}
+	assert.False(t, Run(context.Background(), path, out))
+	assert.Contains(t, out.String(), "PASS config fields\n")
+	assert.Contains(t, out.String(), "FAIL service account key: ")
+	assert.Contains(t, out.String(), "FAIL HAP storage path writable: storage path cannot be created")
+}
+
+func TestCheckStoragePath(t *testing.T) {
+	t.Parallel()
+
+	t.Run("unset", func(t *testing.T) {
+		t.Parallel()
+		assert.Error(t, checkStoragePath(context.Background(), &config.Config{}))
+	})
+
+	t.Run("existing directory", func(t *testing.T) {
+		t.Parallel()
+		dir := t.TempDir()
+
+		assert.NoError(t, checkStoragePath(context.Background(), &config.Config{StoragePath: dir}))
+
+		entries, err := os.ReadDir(dir)
+		require.NoError(t, err)
+		assert.Empty(t, entries)
+	})
+
+	t.Run("missing directory is not created", func(t *testing.T) {
+		t.Parallel()
+		cfg := &config.Config{StoragePath: filepath.Join(t.TempDir(), "data", "hap")}
+
+		assert.NoError(t, checkStoragePath(context.Background(), cfg))
+		assert.NoDirExists(t, filepath.Dir(cfg.StoragePath))
+	})
+
+	t.Run("parent is a file", func(t *testing.T) {
+		t.Parallel()
+		file := filepath.Join(t.TempDir(), "file")
+		require.NoError(t, os.WriteFile(file, nil, 0o600))
+
+		err := checkStoragePath(context.Background(), &config.Config{StoragePath: filepath.Join(file, "data")})
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "is not a directory")
+	})
+}
@@ -7,14 +7,19 @@ import (
 
 var ErrSvcNotEnabled error = errors.New("service is not enabled")
 
-func ErrListToErr(prefix string, errs []error) error {
-	if len(errs) == 0 {
-		return nil
-	}
+var ErrSubscriptionNotFound error = errors.New("subscription does not exist")
+
+// ErrList is an error made of several errors. errors.Is and errors.As match
+// any error of the list.
+type ErrList struct {
+	Prefix string
+	Errs   []error
+}
 
+func (e *ErrList) Error() string {
 	var s string
 
-	for _, e := range errs {
+	for _, e := range e.Errs {
 		if e != nil {
 			if s == "" {
 				s = fmt.Sprintf(": %s", e.Error())
@@ -24,5 +29,37 @@ func ErrListToErr(prefix string, errs []error) error {
 		}
 	}
 
-	return fmt.Errorf("%s%s", prefix, s)
+	return fmt.Sprintf("%s%s", e.Prefix, s)
+}
+
+func (e *ErrList) Is(target error) bool {
+	for _, err := range e.Errs {
+		if err != nil && errors.Is(err, target) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (e *ErrList) As(target interface{}) bool {
+	for _, err := range e.Errs {
+		if err != nil && errors.As(err, target) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ErrListToErr returns an *ErrList of errs, or nil if errs is empty
+func ErrListToErr(prefix string, errs []error) error {
+	if len(errs) == 0 {
+		return nil
+	}
+
+	return &ErrList{
+		Prefix: prefix,
+		Errs:   errs,
+	}
 }
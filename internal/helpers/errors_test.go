@@ -2,6 +2,7 @@ package helpers_test
 
 import (
 	"errors"
+	"fmt"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -27,3 +28,41 @@ func TestErrorListToErr(t *testing.T) {
 		assert.Equal(t, "poke: me, you", helpers.ErrListToErr(prefix, errs).Error())
 	})
 }
+
+type testError struct {
+	code int
+}
+
+func (e *testError) Error() string {
+	return "test error"
+}
+
+func TestErrList(t *testing.T) {
+	t.Parallel()
+
+	sentinel := errors.New("sentinel")
+	err := helpers.ErrListToErr("poke", []error{
+		errors.New("me"),
+		nil,
+		fmt.Errorf("wrapped: %w", &testError{code: 7}),
+		sentinel,
+	})
+
+	t.Run("Is matches any error", func(t *testing.T) {
+		t.Parallel()
+		assert.True(t, errors.Is(err, sentinel))
+		assert.False(t, errors.Is(err, helpers.ErrSvcNotEnabled))
+	})
+
+	t.Run("As matches any error", func(t *testing.T) {
+		t.Parallel()
+
+		var list *helpers.ErrList
+		assert.True(t, errors.As(err, &list))
+		assert.Len(t, list.Errs, 4)
+
+		var te *testError
+		assert.True(t, errors.As(err, &te))
+		assert.Equal(t, 7, te.code)
+	})
+}
@@ -1,14 +1,20 @@
 package onboard
 
 import (
+	"bufio"
 	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"net/url"
-	"sync"
+	"strings"
 	"time"
 
+	"cloud.google.com/go/pubsub"
 	"github.com/yangl1996/nesthub/internal/config"
 	"github.com/yangl1996/nesthub/internal/helpers"
 	"google.golang.org/api/option"
@@ -21,21 +27,33 @@ func SvcEnabled(ctx context.Context, cfg *config.Config, svcName string) error {
 		return fmt.Errorf("failed to create Service Usage client: %w", err)
 	}
 
-	parent := fmt.Sprintf("projects/%s", cfg.GCPProjectID)
+	return svcEnabled(ctx, s, cfg.GCPProjectID, svcName)
+}
+
+// svcEnabled returns helpers.ErrSvcNotEnabled unless svcName is enabled in
+// the project
+func svcEnabled(ctx context.Context, s *su.Service, project, svcName string) error {
+	parent := fmt.Sprintf("projects/%s", project)
 	svc := fmt.Sprintf("%s/services/%s", parent, svcName)
 
-	resp, err := s.Services.BatchGet(parent).Names(svc).Do()
+	resp, err := s.Services.BatchGet(parent).Names(svc).Context(ctx).Do()
 	if err != nil {
 		return fmt.Errorf("failed to get the status of service %s: %w", svcName, err)
 	}
 
+	// the name of the returned service is qualified with the project number,
+	// its config carries the bare service name
 	for _, svc := range resp.Services {
-		if svc.Name == svcName && svc.State != "ENABLED" {
-			return helpers.ErrSvcNotEnabled
+		if svc.Config != nil && svc.Config.Name == svcName {
+			if svc.State != "ENABLED" {
+				return helpers.ErrSvcNotEnabled
+			}
+
+			return nil
 		}
 	}
 
-	return nil
+	return helpers.ErrSvcNotEnabled
 }
 
 func EnableSvc(ctx context.Context, cfg *config.Config, svcName string) error {
@@ -76,46 +94,118 @@ func EnableSvc(ctx context.Context, cfg *config.Config, svcName string) error {
 	return nil
 }
 
-func AuthorizeOAuthToken(ctx context.Context, cfg *config.Config) error {
-	log.Println("Authorizing oauth token")
+func SubscriptionExists(ctx context.Context, cfg *config.Config) error {
+	c, err := cfg.NewPubsubClient(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to create pubsub client: %w", err)
+	}
 
-	authCode := ""
-	authURL := fmt.Sprintf(
-		"https://nestservices.google.com/partnerconnections/%s/auth?redirect_uri=%s&access_type=offline&prompt=consent&client_id=%s&response_type=code&scope=https://www.googleapis.com/auth/sdm.service",
-		cfg.SDMProjectID,
-		cfg.SetupRedirectUri,
-		cfg.OAuthClientID,
-	)
+	defer c.Close()
 
-	authDone := &sync.WaitGroup{}
+	ok, err := c.Subscription(cfg.PubsubSubscription).Exists(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to check if subscription %s exists: %w", cfg.PubsubSubscription, err)
+	}
 
-	u, err := url.Parse(cfg.SetupRedirectUri)
+	if !ok {
+		return helpers.ErrSubscriptionNotFound
+	}
+
+	return nil
+}
+
+// SubscriptionConsumable checks that the service account may pull messages
+// from the subscription
+func SubscriptionConsumable(ctx context.Context, cfg *config.Config) error {
+	const permission = "pubsub.subscriptions.consume"
+
+	c, err := cfg.NewPubsubClient(ctx)
 	if err != nil {
-		return fmt.Errorf("error parsing redirect uri: %w", err)
+		return fmt.Errorf("failed to create pubsub client: %w", err)
 	}
 
-	handler := func(w http.ResponseWriter, r *http.Request) {
-		keys := r.URL.Query()
+	defer c.Close()
 
-		authCode = keys.Get("code")
-		if len(authCode) == 0 {
-			fmt.Fprintf(w, "Bad redirect.")
+	granted, err := c.Subscription(cfg.PubsubSubscription).IAM().TestPermissions(ctx, []string{permission})
+	if err != nil {
+		return fmt.Errorf("failed to test permissions on subscription %s: %w", cfg.PubsubSubscription, err)
+	}
+
+	for _, p := range granted {
+		if p == permission {
+			return nil
 		}
+	}
 
-		fmt.Fprintf(w, "Successful authorization. Please go back to Terminal.")
+	return fmt.Errorf("service account lacks %s on subscription %s", permission, cfg.PubsubSubscription)
+}
+
+func CreateSubscription(ctx context.Context, cfg *config.Config) error {
+	log.Printf("Creating subscription %s", cfg.PubsubSubscription)
+
+	c, err := cfg.NewPubsubClient(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to create pubsub client: %w", err)
+	}
+
+	defer c.Close()
+
+	// SDM publishes the events of an enterprise to a topic in its own project
+	subCfg := pubsub.SubscriptionConfig{
+		Topic: c.TopicInProject("enterprise-"+cfg.SDMProjectID, "sdm-prod"),
+	}
 
-		authDone.Done()
+	if _, err := c.CreateSubscription(ctx, cfg.PubsubSubscription, subCfg); err != nil {
+		return fmt.Errorf("failed to create subscription %s: %w", cfg.PubsubSubscription, err)
 	}
 
+	log.Println("Subscription created")
+
+	return nil
+}
+
+func AuthorizeOAuthToken(ctx context.Context, cfg *config.Config) error {
+	log.Println("Authorizing oauth token")
+
+	state, err := newState()
+	if err != nil {
+		return err
+	}
+
+	authURL := partnerConnectionsURL(cfg, state)
+
+	u, err := url.Parse(cfg.SetupRedirectUri)
+	if err != nil {
+		return fmt.Errorf("error parsing redirect uri: %w", err)
+	}
+
+	done := make(chan authResult, 1)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", callbackHandler(state, done))
+
 	srv := &http.Server{
 		Addr:              fmt.Sprintf(":%s", u.Port()),
+		Handler:           mux,
 		ReadHeaderTimeout: 1 * time.Second,
 	}
 
-	http.HandleFunc("/", handler)
-
 	// start the server to receive callback from the browser
-	go srv.ListenAndServe() //nolint:errcheck
+	go func() {
+		if err := srv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+			sendResult(done, authResult{err: fmt.Errorf("failed to start the callback server: %w", err)})
+		}
+	}()
+
+	defer func() {
+		// the flow context may have expired already
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			log.Printf("failed to shutdown the callback server: %v", err)
+		}
+	}()
 
 	// send user to the browser to authorize the token
 	if err := helpers.OpenURL(authURL); err != nil {
@@ -123,18 +213,222 @@ func AuthorizeOAuthToken(ctx context.Context, cfg *config.Config) error {
 	}
 
 	// wait for authorization to finish
-	authDone.Add(1)
-	authDone.Wait()
+	ctx, cancel := context.WithTimeout(ctx, cfg.SetupTimeoutDuration())
+	defer cancel()
+
+	var res authResult
+	select {
+	case res = <-done:
+	case <-ctx.Done():
+		return fmt.Errorf("authorization did not finish in %s: %w", cfg.SetupTimeout, ctx.Err())
+	}
 
-	if err := srv.Shutdown(ctx); err != nil {
-		return fmt.Errorf("failed to shutdown the server: %w", err)
+	if res.err != nil {
+		return res.err
 	}
 
 	log.Println("Authorization successful")
 
-	if err := cfg.WriteOAuthTokenToFile(authCode, cfg.OAuthTokenPath); err != nil {
+	if err := cfg.WriteOAuthTokenToFile(ctx, res.code, cfg.OAuthTokenPath); err != nil {
 		return err
 	}
 
 	return nil
 }
+
+// authResult is the outcome of the oauth callback
+type authResult struct {
+	code string
+	err  error
+}
+
+// callbackHandler handles the browser redirect of the oauth flow. Only the first
+// redirect carrying the expected state ends the flow, anything else is
+// answered with an error page and the flow keeps waiting.
+func callbackHandler(state string, done chan<- authResult) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		keys := r.URL.Query()
+
+		if keys.Get("state") != state {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "Bad redirect.")
+
+			return
+		}
+
+		if e := keys.Get("error"); e != "" {
+			fmt.Fprintf(w, "Authorization failed: %s. Please go back to Terminal.", e)
+			sendResult(done, authResult{err: fmt.Errorf("authorization denied: %s", e)})
+
+			return
+		}
+
+		authCode := keys.Get("code")
+		if len(authCode) == 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "Bad redirect.")
+
+			return
+		}
+
+		fmt.Fprintf(w, "Successful authorization. Please go back to Terminal.")
+		sendResult(done, authResult{code: authCode})
+	}
+}
+
+// sendResult delivers res unless a result was delivered already
+func sendResult(done chan<- authResult, res authResult) {
+	select {
+	case done <- res:
+	default:
+	}
+}
+
+// newState returns a random oauth state parameter to protect the callback
+// against cross-site request forgery
+func newState() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate oauth state: %w", err)
+	}
+
+	return hex.EncodeToString(b), nil
+}
+
+// AuthorizeOAuthTokenHeadless authorizes the oauth token without a local
+// callback server: the user opens the URL on any device and pastes the URL
+// the browser got redirected to, or just the code in it. Like the browser
+// flow, it gives up after the setup timeout or once ctx is done.
+func AuthorizeOAuthTokenHeadless(ctx context.Context, cfg *config.Config, in io.Reader, out io.Writer) error {
+	log.Println("Authorizing oauth token")
+
+	state, err := newState()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, cfg.SetupTimeoutDuration())
+	defer cancel()
+
+	fmt.Fprintf(out, "Open the following URL in a browser on any device and authorize access:\n\n%s\n\n", partnerConnectionsURL(cfg, state))
+	fmt.Fprintln(out, "The browser is then redirected to a page that likely fails to load.")
+
+	lines := readLines(ctx, in)
+
+	for {
+		fmt.Fprint(out, "Paste the URL from the address bar, or the code in it: ")
+
+		var line lineResult
+		select {
+		case line = <-lines:
+		case <-ctx.Done():
+			return fmt.Errorf("authorization did not finish in %s: %w", cfg.SetupTimeout, ctx.Err())
+		}
+
+		if line.err != nil {
+			return line.err
+		}
+
+		authCode, err := parseAuthCode(line.text, state)
+		if errors.Is(err, errNoAuthCode) {
+			fmt.Fprintln(out, err)
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		log.Println("Authorization successful")
+
+		return cfg.WriteOAuthTokenToFile(ctx, authCode, cfg.OAuthTokenPath)
+	}
+}
+
+// lineResult is a line read from the user, or the error that ended the input
+type lineResult struct {
+	text string
+	err  error
+}
+
+// readLines reads lines from in until it ends or ctx is done. A read blocked
+// on in is left behind when ctx is done, as there is no way to interrupt it.
+func readLines(ctx context.Context, in io.Reader) <-chan lineResult {
+	lines := make(chan lineResult)
+
+	go func() {
+		scanner := bufio.NewScanner(in)
+
+		for {
+			res := lineResult{err: errors.New("no authorization code entered")}
+
+			if scanner.Scan() {
+				res = lineResult{text: scanner.Text()}
+			} else if err := scanner.Err(); err != nil {
+				res.err = fmt.Errorf("failed to read authorization code: %w", err)
+			}
+
+			select {
+			case lines <- res:
+			case <-ctx.Done():
+				return
+			}
+
+			if res.err != nil {
+				return
+			}
+		}
+	}()
+
+	return lines
+}
+
+var errNoAuthCode = errors.New("no authorization code found, please try again")
+
+// parseAuthCode extracts the authorization code from a pasted redirect URL or
+// returns the input itself if it is a bare code. A pasted URL must carry the
+// expected state.
+func parseAuthCode(input, state string) (string, error) {
+	input = strings.TrimSpace(input)
+	if input == "" {
+		return "", errNoAuthCode
+	}
+
+	if !strings.Contains(input, "?") && !strings.Contains(input, "=") {
+		return input, nil
+	}
+
+	query := input
+	if i := strings.Index(input, "?"); i >= 0 {
+		query = input[i+1:]
+	}
+
+	keys, err := url.ParseQuery(query)
+	if err != nil {
+		return "", errNoAuthCode
+	}
+
+	if keys.Has("state") && keys.Get("state") != state {
+		return "", errNoAuthCode
+	}
+
+	if e := keys.Get("error"); e != "" {
+		return "", fmt.Errorf("authorization denied: %s", e)
+	}
+
+	if code := keys.Get("code"); code != "" {
+		return code, nil
+	}
+
+	return "", errNoAuthCode
+}
+
+// partnerConnectionsURL returns the URL where the user grants nesthub access to
+// their devices
+func partnerConnectionsURL(cfg *config.Config, state string) string {
+	return fmt.Sprintf(
+		"https://nestservices.google.com/partnerconnections/%s/auth?redirect_uri=%s&access_type=offline&prompt=consent&client_id=%s&response_type=code&scope=https://www.googleapis.com/auth/sdm.service&state=%s",
+		cfg.SDMProjectID,
+		cfg.SetupRedirectUri,
+		cfg.OAuthClientID,
+		state,
+	)
+}
@@ -0,0 +1,191 @@
+package onboard
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/yangl1996/nesthub/internal/config"
+	"github.com/yangl1996/nesthub/internal/helpers"
+	"google.golang.org/api/option"
+	su "google.golang.org/api/serviceusage/v1"
+)
+
+func TestParseAuthCode(t *testing.T) {
+	t.Parallel()
+
+	t.Run("redirect url", func(t *testing.T) {
+		t.Parallel()
+		code, err := parseAuthCode("http://localhost:7979/?state=xyz&code=4/0AX4XfWh&scope=https://www.googleapis.com/auth/sdm.service\n", "xyz")
+		assert.NoError(t, err)
+		assert.Equal(t, "4/0AX4XfWh", code)
+	})
+
+	t.Run("bare code", func(t *testing.T) {
+		t.Parallel()
+		code, err := parseAuthCode("  4/0AX4XfWh ", "xyz")
+		assert.NoError(t, err)
+		assert.Equal(t, "4/0AX4XfWh", code)
+	})
+
+	t.Run("empty input", func(t *testing.T) {
+		t.Parallel()
+		_, err := parseAuthCode("", "xyz")
+		assert.ErrorIs(t, err, errNoAuthCode)
+	})
+
+	t.Run("url without code", func(t *testing.T) {
+		t.Parallel()
+		_, err := parseAuthCode("http://localhost:7979/?scope=sdm", "xyz")
+		assert.ErrorIs(t, err, errNoAuthCode)
+	})
+
+	t.Run("access denied", func(t *testing.T) {
+		t.Parallel()
+		_, err := parseAuthCode("http://localhost:7979/?state=xyz&error=access_denied", "xyz")
+		assert.EqualError(t, err, "authorization denied: access_denied")
+	})
+
+	t.Run("state mismatch", func(t *testing.T) {
+		t.Parallel()
+		_, err := parseAuthCode("http://localhost:7979/?state=abc&code=4/0AX4XfWh", "xyz")
+		assert.ErrorIs(t, err, errNoAuthCode)
+	})
+}
+
+func TestCallbackHandler(t *testing.T) {
+	t.Parallel()
+
+	redirect := func(h http.HandlerFunc, query string) int {
+		w := httptest.NewRecorder()
+		h(w, httptest.NewRequest(http.MethodGet, "/?"+query, nil))
+
+		return w.Code
+	}
+
+	t.Run("bad redirects keep waiting", func(t *testing.T) {
+		t.Parallel()
+
+		done := make(chan authResult, 1)
+		h := callbackHandler("xyz", done)
+
+		assert.Equal(t, http.StatusBadRequest, redirect(h, "code=stolen"))
+		assert.Equal(t, http.StatusBadRequest, redirect(h, "state=abc&code=stolen"))
+		assert.Equal(t, http.StatusBadRequest, redirect(h, "state=xyz"))
+		assert.Empty(t, done)
+
+		assert.Equal(t, http.StatusOK, redirect(h, "state=xyz&code=good"))
+		assert.Equal(t, authResult{code: "good"}, <-done)
+	})
+
+	t.Run("repeated redirects", func(t *testing.T) {
+		t.Parallel()
+
+		done := make(chan authResult, 1)
+		h := callbackHandler("xyz", done)
+
+		assert.Equal(t, http.StatusOK, redirect(h, "state=xyz&code=first"))
+		assert.Equal(t, http.StatusOK, redirect(h, "state=xyz&code=second"))
+		assert.Equal(t, authResult{code: "first"}, <-done)
+	})
+
+	t.Run("google error", func(t *testing.T) {
+		t.Parallel()
+
+		done := make(chan authResult, 1)
+		h := callbackHandler("xyz", done)
+
+		assert.Equal(t, http.StatusOK, redirect(h, "state=xyz&error=access_denied"))
+		assert.EqualError(t, (<-done).err, "authorization denied: access_denied")
+	})
+}
+
+func TestAuthorizeOAuthTokenHeadless(t *testing.T) {
+	t.Parallel()
+
+	cfg := &config.Config{SetupTimeout: "5m"}
+
+	t.Run("cancelled while waiting for input", func(t *testing.T) {
+		t.Parallel()
+
+		in, w := io.Pipe()
+		t.Cleanup(func() { w.Close() })
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		err := AuthorizeOAuthTokenHeadless(ctx, cfg, in, io.Discard)
+		assert.ErrorIs(t, err, context.Canceled)
+	})
+
+	t.Run("times out", func(t *testing.T) {
+		t.Parallel()
+
+		in, w := io.Pipe()
+		t.Cleanup(func() { w.Close() })
+
+		err := AuthorizeOAuthTokenHeadless(context.Background(), &config.Config{SetupTimeout: "10ms"}, in, io.Discard)
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+	})
+
+	t.Run("input ends without a code", func(t *testing.T) {
+		t.Parallel()
+
+		var out strings.Builder
+
+		err := AuthorizeOAuthTokenHeadless(context.Background(), cfg, strings.NewReader("\nhttp://localhost:7979/?scope=sdm\n"), &out)
+		assert.EqualError(t, err, "no authorization code entered")
+		assert.Equal(t, 2, strings.Count(out.String(), errNoAuthCode.Error()))
+	})
+}
+
+func TestSvcEnabled(t *testing.T) {
+	t.Parallel()
+
+	const svcName = "smartdevicemanagement.googleapis.com"
+
+	// batchGet answers as the Service Usage API does, with the service name
+	// qualified by the project number
+	batchGet := func(t *testing.T, state string) *su.Service {
+		t.Helper()
+
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			assert.Equal(t, "/v1/projects/gcp/services:batchGet", r.URL.Path)
+
+			fmt.Fprintf(w, `{"services": [{
+				"name": "projects/123456789/services/%s",
+				"config": {"name": "%s"},
+				"state": "%s"
+			}]}`, svcName, svcName, state)
+		}))
+		t.Cleanup(srv.Close)
+
+		s, err := su.NewService(context.Background(), option.WithEndpoint(srv.URL+"/"), option.WithoutAuthentication())
+		require.NoError(t, err)
+
+		return s
+	}
+
+	t.Run("enabled", func(t *testing.T) {
+		t.Parallel()
+		assert.NoError(t, svcEnabled(context.Background(), batchGet(t, "ENABLED"), "gcp", svcName))
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		t.Parallel()
+		err := svcEnabled(context.Background(), batchGet(t, "DISABLED"), "gcp", svcName)
+		assert.ErrorIs(t, err, helpers.ErrSvcNotEnabled)
+	})
+
+	t.Run("not listed", func(t *testing.T) {
+		t.Parallel()
+		err := svcEnabled(context.Background(), batchGet(t, "ENABLED"), "gcp", "pubsub.googleapis.com")
+		assert.ErrorIs(t, err, helpers.ErrSvcNotEnabled)
+	})
+}
@@ -0,0 +1,187 @@
+package emulation
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/yangl1996/nesthub/pkg/sdmclient"
+)
+
+// the SDM API requests of all devices together, polls and commands from
+// HomeKit alike, are kept to 10 per minute with bursts of up to 10, below the
+// rate limits of the SDM API. Polls only start while 5 requests of the burst
+// are left, so that they never hold up commands from HomeKit.
+const (
+	sdmBudgetInterval = 6 * time.Second
+	sdmBudgetBurst    = 10
+	pollReserve       = 5
+
+	// budgetWaitTimeout is how long a request waits for the budget before
+	// it fails, rather than being made long after HomeKit gave up on it
+	budgetWaitTimeout = 5 * time.Second
+)
+
+// requestBudget spaces out requests shared by several callers to at most
+// burst at once and one per interval on average
+type requestBudget struct {
+	sync.Mutex
+	interval time.Duration
+	burst    int
+
+	// free is when the budget will be fully replenished
+	free time.Time
+}
+
+func newRequestBudget(interval time.Duration, burst int) *requestBudget {
+	return &requestBudget{interval: interval, burst: burst}
+}
+
+// Wait blocks until a request fits in the budget, or returns the error of ctx
+// if it is done first. A request that gives up leaves its place to the next.
+func (b *requestBudget) Wait(ctx context.Context) error {
+	b.Lock()
+
+	now := time.Now()
+	if b.free.Before(now) {
+		b.free = now
+	}
+
+	// the request may start once the requests before it fit in the burst
+	start := b.free.Add(-time.Duration(b.burst-1) * b.interval)
+	b.free = b.free.Add(b.interval)
+
+	b.Unlock()
+
+	if err := sleep(ctx, start.Sub(now)); err != nil {
+		b.Lock()
+		b.free = b.free.Add(-b.interval)
+		b.Unlock()
+
+		return err
+	}
+
+	return nil
+}
+
+// WaitHeadroom blocks until n requests fit in the budget at once, without
+// using any of them, or returns the error of ctx if it is done first
+func (b *requestBudget) WaitHeadroom(ctx context.Context, n int) error {
+	for {
+		b.Lock()
+
+		now := time.Now()
+		free := b.free
+		if free.Before(now) {
+			free = now
+		}
+
+		// the n-th request from now would start at
+		ready := free.Add(time.Duration(n-b.burst) * b.interval)
+
+		b.Unlock()
+
+		if !ready.After(now) {
+			return nil
+		}
+
+		// other requests may have used the budget in the meantime
+		if err := sleep(ctx, ready.Sub(now)); err != nil {
+			return err
+		}
+	}
+}
+
+// sleep waits for d, or returns the error of ctx if it is done first
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// budgetedDevice makes the SDM API requests of a device within a budget
+// shared with the other devices. Requests that can't get the budget within
+// timeout fail.
+type budgetedDevice struct {
+	sdmclient.Device
+	budget  *requestBudget
+	timeout time.Duration
+}
+
+func (d *budgetedDevice) wait() error {
+	ctx, cancel := context.WithTimeout(context.Background(), d.timeout)
+	defer cancel()
+
+	if err := d.budget.Wait(ctx); err != nil {
+		return fmt.Errorf("failed to wait for the SDM request budget: %w", err)
+	}
+
+	return nil
+}
+
+func (d *budgetedDevice) GetDevice() (sdmclient.DeviceTraits, error) {
+	if err := d.wait(); err != nil {
+		return sdmclient.DeviceTraits{}, err
+	}
+
+	return d.Device.GetDevice()
+}
+
+func (d *budgetedDevice) SetMode(mode string) error {
+	if err := d.wait(); err != nil {
+		return err
+	}
+
+	return d.Device.SetMode(mode)
+}
+
+func (d *budgetedDevice) SetHeat(temp float64) error {
+	if err := d.wait(); err != nil {
+		return err
+	}
+
+	return d.Device.SetHeat(temp)
+}
+
+func (d *budgetedDevice) SetCool(temp float64) error {
+	if err := d.wait(); err != nil {
+		return err
+	}
+
+	return d.Device.SetCool(temp)
+}
+
+func (d *budgetedDevice) SetHeatCool(heat, cool float64) error {
+	if err := d.wait(); err != nil {
+		return err
+	}
+
+	return d.Device.SetHeatCool(heat, cool)
+}
+
+func (d *budgetedDevice) SetEcoMode(mode string) error {
+	if err := d.wait(); err != nil {
+		return err
+	}
+
+	return d.Device.SetEcoMode(mode)
+}
+
+func (d *budgetedDevice) SetFanTimer(mode string, duration time.Duration) error {
+	if err := d.wait(); err != nil {
+		return err
+	}
+
+	return d.Device.SetFanTimer(mode, duration)
+}
@@ -0,0 +1,99 @@
+package emulation
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/yangl1996/nesthub/pkg/sdmclient"
+)
+
+func TestRequestBudget(t *testing.T) {
+	t.Parallel()
+
+	t.Run("burst then spaced out", func(t *testing.T) {
+		t.Parallel()
+
+		b := newRequestBudget(50*time.Millisecond, 2)
+		ctx := context.Background()
+		start := time.Now()
+
+		assert.NoError(t, b.Wait(ctx))
+		assert.NoError(t, b.Wait(ctx))
+		assert.Less(t, time.Since(start), 25*time.Millisecond)
+
+		assert.NoError(t, b.Wait(ctx))
+		assert.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+	})
+
+	t.Run("context done while waiting", func(t *testing.T) {
+		t.Parallel()
+
+		b := newRequestBudget(time.Hour, 2)
+		assert.NoError(t, b.Wait(context.Background()))
+		assert.NoError(t, b.Wait(context.Background()))
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+
+		assert.ErrorIs(t, b.Wait(ctx), context.DeadlineExceeded)
+
+		// the request that gave up doesn't hold up the next one
+		assert.InDelta(t, 2*time.Hour, time.Until(b.free), float64(time.Second))
+	})
+
+	t.Run("headroom is not used up", func(t *testing.T) {
+		t.Parallel()
+
+		b := newRequestBudget(time.Hour, 3)
+		ctx := context.Background()
+
+		assert.NoError(t, b.WaitHeadroom(ctx, 3))
+		assert.NoError(t, b.WaitHeadroom(ctx, 3))
+		assert.NoError(t, b.Wait(ctx))
+
+		// only two requests are left
+		ctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+		defer cancel()
+
+		assert.ErrorIs(t, b.WaitHeadroom(ctx, 3), context.DeadlineExceeded)
+		assert.NoError(t, b.WaitHeadroom(ctx, 2))
+	})
+
+	t.Run("headroom comes back over time", func(t *testing.T) {
+		t.Parallel()
+
+		b := newRequestBudget(50*time.Millisecond, 2)
+		ctx := context.Background()
+		start := time.Now()
+
+		assert.NoError(t, b.Wait(ctx))
+		assert.NoError(t, b.Wait(ctx))
+
+		assert.NoError(t, b.WaitHeadroom(ctx, 2))
+		assert.GreaterOrEqual(t, time.Since(start), 100*time.Millisecond)
+	})
+}
+
+func TestBudgetedDevice(t *testing.T) {
+	t.Parallel()
+
+	fake := &sdmclient.Fake{}
+	d := &budgetedDevice{Device: fake, budget: newRequestBudget(time.Hour, 2), timeout: 50 * time.Millisecond}
+
+	require.NoError(t, d.SetMode(HEAT))
+	_, err := d.GetDevice()
+	require.NoError(t, err)
+	assert.Len(t, fake.Commands, 1)
+
+	// commands are held up by the budget as well, and fail rather than
+	// being made once it has room
+	err = d.SetHeat(21)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Len(t, fake.Commands, 1)
+
+	_, err = d.GetDevice()
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
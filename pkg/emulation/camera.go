@@ -0,0 +1,212 @@
+package emulation
+
+import (
+	"log"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/brutella/hap/accessory"
+	"github.com/brutella/hap/characteristic"
+	"github.com/brutella/hap/service"
+	"github.com/yangl1996/nesthub/internal/config"
+	sdm "google.golang.org/api/smartdevicemanagement/v1"
+)
+
+// EmulatedCamera bridges the events of a Nest camera or doorbell to HomeKit
+// sensors. Cameras have no state to query, so only pubsub events are used.
+type EmulatedCamera struct {
+	Name     string
+	Motion   *service.MotionSensor
+	Person   *service.OccupancySensor
+	Sound    *service.ContactSensor
+	Doorbell *service.Doorbell
+
+	motion *heldSensor
+	person *heldSensor
+	sound  *heldSensor
+	a      *accessory.A
+
+	// mu guards hold, which changes when the config is reloaded
+	mu   sync.Mutex
+	hold time.Duration
+}
+
+func NewEmulatedCamera(d *sdm.GoogleHomeEnterpriseSdmV1Device, c *config.Config) (*EmulatedCamera, error) {
+	kind := "Camera"
+	if d.Type == TypeDoorbell {
+		kind = "Doorbell"
+	}
+
+	a := accessory.New(accessory.Info{
+		Name:         displayName(d, kind),
+		SerialNumber: path.Base(d.Name),
+		Manufacturer: "Google Nest",
+		Model:        kind,
+	}, accessory.TypeSensor)
+	a.Id = accessoryID(d.Name)
+
+	e := &EmulatedCamera{
+		Name: d.Name,
+		hold: c.SensorHoldDuration(),
+		a:    a,
+	}
+
+	// only the events the device reports a trait for get a sensor
+	if hasTrait(d, "sdm.devices.traits.CameraMotion") {
+		e.Motion = service.NewMotionSensor()
+		e.Motion.AddC(newName("Motion").C)
+		a.AddS(e.Motion.S)
+
+		e.motion = &heldSensor{set: e.Motion.MotionDetected.SetValue}
+	}
+
+	if hasTrait(d, "sdm.devices.traits.CameraPerson") {
+		e.Person = service.NewOccupancySensor()
+		e.Person.AddC(newName("Person").C)
+		a.AddS(e.Person.S)
+
+		e.person = &heldSensor{set: func(detected bool) {
+			v := characteristic.OccupancyDetectedOccupancyNotDetected
+			if detected {
+				v = characteristic.OccupancyDetectedOccupancyDetected
+			}
+
+			if err := e.Person.OccupancyDetected.SetValue(v); err != nil {
+				log.Println("Nest: Error updating person sensor:", err)
+			}
+		}}
+	}
+
+	// HomeKit has no sound sensor, sound opens a contact sensor so that it
+	// can't be mistaken for motion
+	if hasTrait(d, "sdm.devices.traits.CameraSound") {
+		e.Sound = service.NewContactSensor()
+		e.Sound.AddC(newName("Sound").C)
+		a.AddS(e.Sound.S)
+
+		e.sound = &heldSensor{set: func(detected bool) {
+			v := characteristic.ContactSensorStateContactDetected
+			if detected {
+				v = characteristic.ContactSensorStateContactNotDetected
+			}
+
+			if err := e.Sound.ContactSensorState.SetValue(v); err != nil {
+				log.Println("Nest: Error updating sound sensor:", err)
+			}
+		}}
+	}
+
+	if hasTrait(d, "sdm.devices.traits.DoorbellChime") {
+		e.Doorbell = service.NewDoorbell()
+		e.Doorbell.AddC(newName("Doorbell").C)
+		a.AddS(e.Doorbell.S)
+	}
+
+	return e, nil
+}
+
+// Accessory returns the HomeKit sensor accessory of the camera
+func (e *EmulatedCamera) Accessory() *accessory.A {
+	return e.a
+}
+
+// Reconfigure applies the sensor hold time of a reloaded config to the events
+// received after it
+func (e *EmulatedCamera) Reconfigure(c *config.Config) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.hold = c.SensorHoldDuration()
+}
+
+// UpdateTraits triggers the sensors of the events in the update. Events older
+// than the hold time, e.g. redelivered after an outage, are ignored.
+func (e *EmulatedCamera) UpdateTraits(t PubsubUpdate) {
+	e.mu.Lock()
+	hold := e.hold
+	e.mu.Unlock()
+
+	if time.Since(t.Timestamp) > hold {
+		return
+	}
+
+	events := t.ResourceUpdate.Events
+
+	if events.Motion != nil && e.motion != nil {
+		e.motion.trigger(hold)
+		log.Println("Nest: Motion detected by", e.Name)
+	}
+
+	if events.Person != nil && e.person != nil {
+		e.person.trigger(hold)
+		log.Println("Nest: Person detected by", e.Name)
+	}
+
+	if events.Sound != nil && e.sound != nil {
+		e.sound.trigger(hold)
+		log.Println("Nest: Sound detected by", e.Name)
+	}
+
+	if events.Chime != nil && e.Doorbell != nil {
+		if err := e.Doorbell.ProgrammableSwitchEvent.SetValue(characteristic.ProgrammableSwitchEventSinglePress); err != nil {
+			log.Println("Nest: Error updating doorbell:", err)
+			return
+		}
+
+		log.Println("Nest: Doorbell pressed on", e.Name)
+	}
+}
+
+// heldSensor is a boolean sensor that resets itself once no event has
+// triggered it for the hold time
+type heldSensor struct {
+	sync.Mutex
+	set  func(bool)
+	stop func() bool
+	gen  uint64
+
+	// afterFunc schedules the reset, time.AfterFunc if nil
+	afterFunc func(d time.Duration, f func()) (stop func() bool)
+}
+
+func (s *heldSensor) trigger(hold time.Duration) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.set(true)
+
+	if s.stop != nil {
+		s.stop()
+	}
+
+	// a timer that already fired but is waiting for the lock must not reset
+	// the sensor triggered after it
+	s.gen++
+	gen := s.gen
+
+	afterFunc := s.afterFunc
+	if afterFunc == nil {
+		afterFunc = func(d time.Duration, f func()) func() bool {
+			return time.AfterFunc(d, f).Stop
+		}
+	}
+
+	s.stop = afterFunc(hold, func() {
+		s.Lock()
+		defer s.Unlock()
+
+		if s.gen == gen {
+			s.set(false)
+		}
+	})
+}
+
+// newName returns a Name characteristic, used to label services sharing an
+// accessory
+func newName(name string) *characteristic.Name {
+	n := characteristic.NewName()
+	n.SetValue(name)
+
+	return n
+}
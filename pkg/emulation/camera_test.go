@@ -0,0 +1,107 @@
+package emulation
+
+import (
+	"testing"
+	"time"
+
+	"github.com/brutella/hap/accessory"
+	"github.com/brutella/hap/characteristic"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/yangl1996/nesthub/internal/config"
+	"github.com/yangl1996/nesthub/pkg/sdmclient"
+	sdm "google.golang.org/api/smartdevicemanagement/v1"
+)
+
+// fakeTimer is a timer of heldSensor.afterFunc that fires when told to
+type fakeTimer struct {
+	d       time.Duration
+	f       func()
+	stopped bool
+}
+
+func TestHeldSensor(t *testing.T) {
+	t.Parallel()
+
+	var detected bool
+
+	var timers []*fakeTimer
+
+	s := &heldSensor{
+		set: func(v bool) { detected = v },
+		afterFunc: func(d time.Duration, f func()) func() bool {
+			timer := &fakeTimer{d: d, f: f}
+			timers = append(timers, timer)
+
+			return func() bool {
+				timer.stopped = true
+				return true
+			}
+		},
+	}
+
+	s.trigger(time.Minute)
+	assert.True(t, detected)
+	require.Len(t, timers, 1)
+	assert.Equal(t, time.Minute, timers[0].d)
+
+	// retriggering extends the hold
+	s.trigger(time.Minute)
+	require.Len(t, timers, 2)
+	assert.True(t, timers[0].stopped)
+
+	// the first timer fired before it was stopped
+	timers[0].f()
+	assert.True(t, detected)
+
+	timers[1].f()
+	assert.False(t, detected)
+}
+
+func TestNewEmulatedCamera(t *testing.T) {
+	t.Parallel()
+
+	c := &config.Config{SensorHoldTime: "1m"}
+
+	t.Run("camera", func(t *testing.T) {
+		t.Parallel()
+
+		e, err := NewEmulatedCamera(&sdm.GoogleHomeEnterpriseSdmV1Device{
+			Name:   "enterprises/project/devices/camera",
+			Type:   TypeCamera,
+			Traits: []byte(`{"sdm.devices.traits.CameraMotion": {}, "sdm.devices.traits.CameraSound": {}}`),
+		}, c)
+		require.NoError(t, err)
+
+		assert.Equal(t, accessory.TypeSensor, e.Accessory().Type)
+		assert.NotNil(t, e.Motion)
+		assert.Nil(t, e.Person)
+		assert.Nil(t, e.Doorbell)
+
+		e.UpdateTraits(soundEvent(time.Now()))
+		assert.Equal(t, characteristic.ContactSensorStateContactNotDetected, e.Sound.ContactSensorState.Value())
+		assert.False(t, e.Motion.MotionDetected.Value())
+	})
+
+	t.Run("doorbell", func(t *testing.T) {
+		t.Parallel()
+
+		e, err := NewEmulatedCamera(&sdm.GoogleHomeEnterpriseSdmV1Device{
+			Name:   "enterprises/project/devices/doorbell",
+			Type:   TypeDoorbell,
+			Traits: []byte(`{"sdm.devices.traits.CameraMotion": {}, "sdm.devices.traits.DoorbellChime": {}}`),
+		}, c)
+		require.NoError(t, err)
+
+		assert.NotNil(t, e.Doorbell)
+		assert.Nil(t, e.Sound)
+	})
+}
+
+// soundEvent returns a pubsub update of a sound event at ts
+func soundEvent(ts time.Time) PubsubUpdate {
+	u := PubsubUpdate{Timestamp: ts}
+	u.ResourceUpdate.Events.Sound = &sdmclient.Event{}
+
+	return u
+}
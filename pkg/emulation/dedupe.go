@@ -0,0 +1,49 @@
+package emulation
+
+import (
+	"container/list"
+	"sync"
+)
+
+// seenEventsSize is the number of event IDs remembered, well above the
+// number of events redelivered after a typical outage
+const seenEventsSize = 1024
+
+// eventLRU remembers the most recently seen pubsub event IDs so that
+// redelivered events can be dropped
+type eventLRU struct {
+	sync.Mutex
+	size  int
+	order *list.List
+	ids   map[string]*list.Element
+}
+
+func newEventLRU(size int) *eventLRU {
+	return &eventLRU{
+		size:  size,
+		order: list.New(),
+		ids:   make(map[string]*list.Element),
+	}
+}
+
+// seen records id and returns true if it was recorded before. The least
+// recently seen ID is forgotten once the LRU is full.
+func (l *eventLRU) seen(id string) bool {
+	l.Lock()
+	defer l.Unlock()
+
+	if e, ok := l.ids[id]; ok {
+		l.order.MoveToFront(e)
+		return true
+	}
+
+	l.ids[id] = l.order.PushFront(id)
+
+	if l.order.Len() > l.size {
+		oldest := l.order.Back()
+		l.order.Remove(oldest)
+		delete(l.ids, oldest.Value.(string))
+	}
+
+	return false
+}
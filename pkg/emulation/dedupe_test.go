@@ -0,0 +1,21 @@
+package emulation
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEventLRU(t *testing.T) {
+	t.Parallel()
+
+	l := newEventLRU(2)
+	assert.False(t, l.seen("a"))
+	assert.False(t, l.seen("b"))
+	assert.True(t, l.seen("a"))
+
+	// b is the least recently seen and is forgotten
+	assert.False(t, l.seen("c"))
+	assert.True(t, l.seen("a"))
+	assert.False(t, l.seen("b"))
+}
@@ -1,19 +1,20 @@
 package emulation
 
 import (
-	"context"
 	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
+	"path"
 	"sync"
 	"time"
 
-	"cloud.google.com/go/pubsub"
+	"github.com/brutella/hap"
+	"github.com/brutella/hap/accessory"
+	"github.com/brutella/hap/characteristic"
 	"github.com/brutella/hap/service"
 	"github.com/yangl1996/nesthub/internal/config"
 	"github.com/yangl1996/nesthub/pkg/sdmclient"
-	"google.golang.org/api/option"
 	sdm "google.golang.org/api/smartdevicemanagement/v1"
 )
 
@@ -22,76 +23,152 @@ const (
 	HEAT     = "HEAT"
 	COOL     = "COOL"
 	HEATCOOL = "HEATCOOL"
+	ECO      = "MANUAL_ECO"
+	ON       = "ON"
+
+	HEATING = "HEATING"
+	COOLING = "COOLING"
+
+	CELSIUS    = "CELSIUS"
+	FAHRENHEIT = "FAHRENHEIT"
+
+	ONLINE  = "ONLINE"
+	OFFLINE = "OFFLINE"
 )
 
+// PubsubUpdate is an SDM event message. SDM delivers them at least once and in
+// no particular order, EventID identifies redeliveries.
 type PubsubUpdate struct {
+	EventID        string `json:"eventId"`
+	UserID         string `json:"userId"`
 	Timestamp      time.Time
 	ResourceUpdate struct {
+		Name   string
 		Traits sdmclient.DeviceTraits
+		Events sdmclient.DeviceEvents
 	}
 }
 
-type EmulatedDevice struct {
-	*sdmclient.DeviceEndpoint
-	sub *pubsub.Subscription
-	*sync.Mutex
-	state sdmclient.DeviceTraits
-	*service.Thermostat
-}
-
-func NewEmulatedDevice(ctx context.Context, c *config.Config, t *service.Thermostat) (*EmulatedDevice, error) {
-	// Setup sdm service
-	tokenSource, err := c.NewOAuthTokenSource(ctx)
-	if err != nil {
-		return nil, fmt.Errorf("failed to get oauth token source: %w", err)
+// thermostatState is the last known value of each trait, with the timestamp of
+// the update that set it
+type thermostatState struct {
+	Connectivity struct {
+		Status    string
+		Timestamp time.Time
 	}
-
-	s, err := sdm.NewService(ctx, option.WithTokenSource(tokenSource))
-	if err != nil {
-		return nil, fmt.Errorf("failed to create sdm service: %w", err)
+	CurrMode struct {
+		Status    string
+		Timestamp time.Time
 	}
-
-	// list the devices
-	resp := ListDevicesWithRetries(s, c)
-
-	log.Println("Retrieved", len(resp.Devices), "devices")
-
-	// TODO: support multiple devices
-	if len(resp.Devices) > 1 {
-		log.Fatalf("nesthub only supports one device, more than one device found: %v", resp.Devices)
+	CurrTemp struct {
+		TempCelsius float64
+		Timestamp   time.Time
+	}
+	DisplayUnit struct {
+		Unit      string
+		Timestamp time.Time
+	}
+	Humidity struct {
+		Percent   float64
+		Timestamp time.Time
+	}
+	TargetMode struct {
+		Mode      string
+		Timestamp time.Time
+	}
+	TargetTemp struct {
+		HeatCelsius   float64
+		CoolCelsius   float64
+		HeatTimestamp time.Time
+		CoolTimestamp time.Time
+	}
+	Eco struct {
+		Mode          string
+		HeatCelsius   float64
+		CoolCelsius   float64
+		Timestamp     time.Time
+		HeatTimestamp time.Time
+		CoolTimestamp time.Time
 	}
-	// TODO: I'm being lazy here by only supporting one device and not checking
-	// the type of the device. Works for me now.
-	dn := resp.Devices[0].Name
+	Fan struct {
+		TimerMode string
+		Timestamp time.Time
+	}
+}
 
-	log.Println("Controlling device", dn)
+type EmulatedDevice struct {
+	sdmclient.Device
+	*sync.Mutex
+	Name  string
+	state thermostatState
+	*service.Thermostat
+	CurrentRelativeHumidity     *characteristic.CurrentRelativeHumidity
+	HeatingThresholdTemperature *characteristic.HeatingThresholdTemperature
+	CoolingThresholdTemperature *characteristic.CoolingThresholdTemperature
+	Eco                         *service.Switch
+	Fan                         *service.FanV2
+	fanDuration                 time.Duration
+	enums                       enumCounter
+	a                           *accessory.A
+}
 
-	de := &sdmclient.DeviceEndpoint{
-		Service: s,
-		Name:    dn,
+// newEmulatedDevice emulates the thermostat d, which is queried and controlled
+// through client
+func newEmulatedDevice(client sdmclient.Device, d *sdm.GoogleHomeEnterpriseSdmV1Device, c *config.Config) (*EmulatedDevice, error) {
+	a := accessory.NewThermostat(accessory.Info{
+		Name:         displayName(d, "Thermostat"),
+		SerialNumber: path.Base(d.Name),
+		Manufacturer: "Google Nest",
+		Model:        "Thermostat",
+	})
+	a.Id = accessoryID(d.Name)
+
+	// humidity is an optional characteristic of the thermostat service
+	h := characteristic.NewCurrentRelativeHumidity()
+	a.Thermostat.AddC(h.C)
+
+	// the thresholds are used in auto mode, where Nest accepts 9-32°C
+	heat := characteristic.NewHeatingThresholdTemperature()
+	heat.SetMinValue(9)
+	heat.SetMaxValue(32)
+	a.Thermostat.AddC(heat.C)
+
+	cool := characteristic.NewCoolingThresholdTemperature()
+	cool.SetMinValue(9)
+	cool.SetMaxValue(32)
+	a.Thermostat.AddC(cool.C)
+
+	// eco mode is exposed as a separate switch on the same accessory, if the
+	// thermostat supports it
+	var eco *service.Switch
+	if hasTrait(d, "sdm.devices.traits.ThermostatEco") {
+		eco = service.NewSwitch()
+		eco.AddC(newName("Eco").C)
+		a.AddS(eco.S)
 	}
 
-	// create pubsub client and subscription
-	pc, err := pubsub.NewClient(ctx, c.GCPProjectID, option.WithCredentialsFile(c.ServiceAccountKey))
-	if err != nil {
-		return nil, err
+	// the fan trait is only reported by thermostats wired to a fan
+	var fan *service.FanV2
+	if hasTrait(d, "sdm.devices.traits.Fan") {
+		fan = service.NewFanV2()
+		a.AddS(fan.S)
 	}
 
 	// initialize the structure
 	e := &EmulatedDevice{
-		sub:            pc.Subscription("homebridge-pubsub"),
-		Mutex:          &sync.Mutex{},
-		DeviceEndpoint: de,
-		Thermostat:     t,
+		Mutex:                       &sync.Mutex{},
+		Device:                      client,
+		Name:                        d.Name,
+		Thermostat:                  a.Thermostat,
+		CurrentRelativeHumidity:     h,
+		HeatingThresholdTemperature: heat,
+		CoolingThresholdTemperature: cool,
+		Eco:                         eco,
+		Fan:                         fan,
+		fanDuration:                 c.FanTimerDuration(),
+		a:                           a.A,
 	}
 
-	// start updating the states through pubsub
-	go func() {
-		if err := e.ListenEvents(); err != nil {
-			log.Printf("pubsub event listener encountered an error: %v", err)
-		}
-	}()
-
 	// query the API once to get the initial traits
 	if err := e.ForceUpdate(); err != nil {
 		return nil, fmt.Errorf("failed to force update device: %w", err)
@@ -102,28 +179,53 @@ func NewEmulatedDevice(ctx context.Context, c *config.Config, t *service.Thermos
 	return e, nil
 }
 
-func ListDevicesWithRetries(s *sdm.Service, c *config.Config) *sdm.GoogleHomeEnterpriseSdmV1ListDevicesResponse {
-	delay := 1
-	delayMultiplier := 2
-	delayMax := 120
-
-	for {
-		resp, err := s.Enterprises.Devices.List("enterprises/" + c.SDMProjectID).Do()
-		if err != nil {
-			delayDuration := time.Duration(delay) * time.Second
-			log.Printf("Failed to connect to SDM API, retrying in %s: %v", delayDuration, err)
-			time.Sleep(delayDuration)
+// displayName picks a human readable name for the device: the custom name set
+// in the Google Home app, or else the room the device is assigned to followed
+// by the kind of device.
+func displayName(d *sdm.GoogleHomeEnterpriseSdmV1Device, kind string) string {
+	var info struct {
+		Info struct {
+			CustomName string `json:"customName"`
+		} `json:"sdm.devices.traits.Info"`
+	}
 
-			delay *= delayMultiplier
-			if delay > delayMax {
-				delay = delayMax
-			}
+	if err := json.Unmarshal(d.Traits, &info); err == nil && info.Info.CustomName != "" {
+		return info.Info.CustomName
+	}
 
-			continue
+	for _, p := range d.ParentRelations {
+		if p.DisplayName != "" {
+			return p.DisplayName + " " + kind
 		}
+	}
+
+	return kind + " " + path.Base(d.Name)
+}
 
-		return resp
+// hasTrait returns true if the device reports the given trait
+func hasTrait(d *sdm.GoogleHomeEnterpriseSdmV1Device, trait string) bool {
+	var traits map[string]json.RawMessage
+	if err := json.Unmarshal(d.Traits, &traits); err != nil {
+		return false
 	}
+
+	_, ok := traits[trait]
+
+	return ok
+}
+
+// Accessory returns the HomeKit thermostat accessory of the device
+func (d *EmulatedDevice) Accessory() *accessory.A {
+	return d.a
+}
+
+// Reconfigure applies the fan duration of a reloaded config to the next time
+// the fan is turned on
+func (d *EmulatedDevice) Reconfigure(c *config.Config) {
+	d.Lock()
+	defer d.Unlock()
+
+	d.fanDuration = c.FanTimerDuration()
 }
 
 func (d *EmulatedDevice) SetupHandlers() {
@@ -140,19 +242,16 @@ func (d *EmulatedDevice) SetupHandlers() {
 	// Reported values must always be in Celsius
 	// Another good reference of all those stuff is
 	// https://github.com/brutella/hap/blob/master/gen/metadata.json
-	d.TargetTemperature.ValueRequestFunc = func(*http.Request) (interface{}, int) {
+	d.TargetTemperature.ValueRequestFunc = d.readHandler(func() (interface{}, error) {
 		// depends on the set mode
-		d.Lock()
-		defer d.Unlock()
-
-		temp := d.TargetTemp()
-
-		return temp, 0
-	}
+		return d.TargetTemp()
+	})
 
+	d.refuseSetpointWrites(d.TargetTemperature.C, "target temperature")
 	d.TargetTemperature.OnValueRemoteUpdate(func(n float64) {
 		// TODO: Set temp in hap as well as SDM to prevent HomeKit delay?
 		if err := d.SetTargetTemp(n); err != nil {
+			d.enums.report(d.Name, err)
 			log.Println("HomeKit: Error updating target temperature:", err)
 			return
 		}
@@ -160,42 +259,118 @@ func (d *EmulatedDevice) SetupHandlers() {
 		log.Println("HomeKit: Target temperature updated to", n)
 	})
 
-	d.CurrentTemperature.ValueRequestFunc = func(*http.Request) (interface{}, int) {
-		d.Lock()
-		defer d.Unlock()
+	d.HeatingThresholdTemperature.ValueRequestFunc = d.readHandler(func() (interface{}, error) {
+		heat, _ := d.Setpoints()
+		return heat, nil
+	})
+
+	d.refuseSetpointWrites(d.HeatingThresholdTemperature.C, "heating threshold")
+	// HomeKit writes both thresholds of a moved range in one request, the
+	// other threshold is taken from its characteristic as it already holds the
+	// value written with this one
+	d.HeatingThresholdTemperature.OnValueRemoteUpdate(func(n float64) {
+		cool := d.CoolingThresholdTemperature.Value()
 
-		temp := d.CurrentTemp()
+		if err := d.SetHeatCool(n, cool); err != nil {
+			log.Println("HomeKit: Error updating heating threshold:", err)
+			return
+		}
+
+		log.Println("HomeKit: Heating threshold updated to", n)
+	})
+
+	d.CoolingThresholdTemperature.ValueRequestFunc = d.readHandler(func() (interface{}, error) {
+		_, cool := d.Setpoints()
+		return cool, nil
+	})
+
+	d.refuseSetpointWrites(d.CoolingThresholdTemperature.C, "cooling threshold")
+	d.CoolingThresholdTemperature.OnValueRemoteUpdate(func(n float64) {
+		heat := d.HeatingThresholdTemperature.Value()
+
+		if err := d.SetHeatCool(heat, n); err != nil {
+			log.Println("HomeKit: Error updating cooling threshold:", err)
+			return
+		}
+
+		log.Println("HomeKit: Cooling threshold updated to", n)
+	})
+
+	if d.Eco != nil {
+		d.Eco.On.ValueRequestFunc = d.readHandler(func() (interface{}, error) {
+			return d.EcoActive(), nil
+		})
+
+		d.refuseWhileOffline(d.Eco.On.C, "eco mode")
+		d.Eco.On.OnValueRemoteUpdate(func(on bool) {
+			mode := OFF
+			if on {
+				mode = ECO
+			}
+
+			if err := d.SetEcoMode(mode); err != nil {
+				log.Println("HomeKit: Error updating eco mode:", err)
+				return
+			}
 
-		return temp, 0
+			log.Println("HomeKit: Eco mode updated to", mode)
+		})
 	}
 
-	d.TemperatureDisplayUnits.ValueRequestFunc = func(*http.Request) (interface{}, int) {
-		d.Lock()
-		defer d.Unlock()
+	if d.Fan != nil {
+		d.Fan.Active.ValueRequestFunc = d.readHandler(func() (interface{}, error) {
+			return d.FanActive(), nil
+		})
+
+		d.refuseWhileOffline(d.Fan.Active.C, "fan")
+		d.Fan.Active.OnValueRemoteUpdate(func(n int) {
+			d.Lock()
+			duration := d.fanDuration
+			d.Unlock()
+
+			var err error
+			if n == characteristic.ActiveActive {
+				err = d.SetFanTimer(ON, duration)
+			} else {
+				err = d.SetFanTimer(OFF, 0)
+			}
 
-		unit := d.DisplayUnit()
+			if err != nil {
+				log.Println("HomeKit: Error updating fan:", err)
+				return
+			}
 
-		return unit, 0
+			log.Println("HomeKit: Fan active updated to", n)
+		})
 	}
 
+	d.CurrentTemperature.ValueRequestFunc = d.readHandler(func() (interface{}, error) {
+		return d.CurrentTemp(), nil
+	})
+
+	d.CurrentRelativeHumidity.ValueRequestFunc = d.readHandler(func() (interface{}, error) {
+		return d.Humidity(), nil
+	})
+
+	d.TemperatureDisplayUnits.ValueRequestFunc = d.readHandler(func() (interface{}, error) {
+		return d.DisplayUnit()
+	})
+
 	/*
 		// SDM does not support changing the display unit
 		d.TemperatureDisplayUnits.OnValueRemoteUpdate(func(n int) {
 		})
 	*/
 
-	d.TargetHeatingCoolingState.ValueRequestFunc = func(*http.Request) (interface{}, int) {
-		d.Lock()
-		defer d.Unlock()
-
-		mode := d.TargetMode()
-
-		return mode, 0
-	}
+	d.TargetHeatingCoolingState.ValueRequestFunc = d.readHandler(func() (interface{}, error) {
+		return d.TargetMode()
+	})
 
+	d.refuseWhileOffline(d.TargetHeatingCoolingState.C, "target mode")
 	d.TargetHeatingCoolingState.OnValueRemoteUpdate(func(n int) {
 		// TODO: Set mode in hap as well as SDM to prevent HomeKit delay?
 		if err := d.SetTargetMode(n); err != nil {
+			d.enums.report(d.Name, err)
 			log.Println("HomeKit: Error updating target mode:", err)
 			return
 		}
@@ -203,80 +378,142 @@ func (d *EmulatedDevice) SetupHandlers() {
 		log.Println("HomeKit: Target mode updated to", n)
 	})
 
-	d.CurrentHeatingCoolingState.ValueRequestFunc = func(*http.Request) (interface{}, int) {
+	d.CurrentHeatingCoolingState.ValueRequestFunc = d.readHandler(func() (interface{}, error) {
+		return d.CurrentMode()
+	})
+}
+
+// readHandler returns a ValueRequestFunc serving reads from the device state.
+// HomeKit is told the device is not responding while it is offline or when
+// the state can't be mapped.
+func (d *EmulatedDevice) readHandler(read func() (interface{}, error)) func(*http.Request) (interface{}, int) {
+	return func(*http.Request) (interface{}, int) {
+		d.Lock()
+		defer d.Unlock()
+
+		if d.Offline() {
+			return nil, hap.JsonStatusServiceCommunicationFailure
+		}
+
+		v, err := read()
+		if err != nil {
+			return nil, d.readFailed(err)
+		}
+
+		return v, 0
+	}
+}
+
+// refuseWhileOffline makes HomeKit writes to c fail while the device is offline
+func (d *EmulatedDevice) refuseWhileOffline(c *characteristic.C, what string) {
+	c.SetValueRequestFunc = func(interface{}, *http.Request) (interface{}, int) {
 		d.Lock()
 		defer d.Unlock()
 
-		mode := d.CurrentMode()
+		if d.Offline() {
+			log.Printf("HomeKit: Refusing to update %s, device %s is offline", what, d.Name)
+			return nil, hap.JsonStatusServiceCommunicationFailure
+		}
 
-		return mode, 0
+		return nil, 0
 	}
 }
 
+// statusNotAllowedInCurrentState is the HAP status of a write the accessory
+// refuses in its current state, hap has no constant for it
+const statusNotAllowedInCurrentState = -70412
+
+// refuseSetpointWrites makes HomeKit writes to the setpoint c fail while the
+// device is offline or in eco mode, where SDM refuses setpoint changes
+func (d *EmulatedDevice) refuseSetpointWrites(c *characteristic.C, what string) {
+	c.SetValueRequestFunc = func(interface{}, *http.Request) (interface{}, int) {
+		d.Lock()
+		defer d.Unlock()
+
+		if d.Offline() {
+			log.Printf("HomeKit: Refusing to update %s, device %s is offline", what, d.Name)
+			return nil, hap.JsonStatusServiceCommunicationFailure
+		}
+
+		if d.EcoActive() {
+			log.Printf("HomeKit: Refusing to update %s, device %s is in eco mode", what, d.Name)
+			return nil, statusNotAllowedInCurrentState
+		}
+
+		return nil, 0
+	}
+}
+
+// Offline returns true if SDM reports the device as unreachable
+func (d *EmulatedDevice) Offline() bool {
+	return d.state.Connectivity.Status == OFFLINE
+}
+
 func (d *EmulatedDevice) CurrentTemp() float64 {
 	return d.state.CurrTemp.TempCelsius
 }
 
-func (d *EmulatedDevice) TargetTemp() float64 {
-	mode := d.state.TargetMode.Mode
-	switch mode {
-	case OFF:
-		return 0
-	case HEAT:
-		return d.state.TargetTemp.HeatCelsius
-	case COOL:
-		return d.state.TargetTemp.CoolCelsius
-	case HEATCOOL:
-		return (d.state.TargetTemp.HeatCelsius + d.state.TargetTemp.CoolCelsius) / 2.0
-	default:
-		panic("unreachable set mode when querying target temp")
+func (d *EmulatedDevice) Humidity() float64 {
+	return d.state.Humidity.Percent
+}
+
+// EcoActive returns true if the thermostat is in eco mode
+func (d *EmulatedDevice) EcoActive() bool {
+	return d.state.Eco.Mode == ECO
+}
+
+// FanActive returns the HomeKit Active value of the fan timer
+func (d *EmulatedDevice) FanActive() int {
+	if d.state.Fan.TimerMode == ON {
+		return characteristic.ActiveActive
 	}
+
+	return characteristic.ActiveInactive
 }
 
-func (d *EmulatedDevice) CurrentMode() int {
-	mode := d.state.CurrMode.Status
-	switch mode {
-	case OFF:
-		return 0
-	case "HEATING":
-		return 1
-	case "COOLING":
-		return 2
-	default:
-		panic("unreachable current mode")
+// Setpoints returns the heat and cool setpoints in effect, which are the eco
+// setpoints while eco mode is active
+func (d *EmulatedDevice) Setpoints() (float64, float64) {
+	if d.EcoActive() {
+		return d.state.Eco.HeatCelsius, d.state.Eco.CoolCelsius
 	}
+
+	return d.state.TargetTemp.HeatCelsius, d.state.TargetTemp.CoolCelsius
 }
 
-func (d *EmulatedDevice) TargetMode() int {
+func (d *EmulatedDevice) TargetTemp() (float64, error) {
+	heat, cool := d.Setpoints()
+
 	mode := d.state.TargetMode.Mode
 	switch mode {
 	case OFF:
-		return 0
+		return 0, nil
 	case HEAT:
-		return 1
+		return heat, nil
 	case COOL:
-		return 2
+		return cool, nil
 	case HEATCOOL:
-		return 3
+		return (heat + cool) / 2.0, nil
 	default:
-		panic("unreachable set mode")
+		return 0, &UnknownEnumError{Enum: "ThermostatMode", Value: mode}
 	}
 }
 
+func (d *EmulatedDevice) CurrentMode() (int, error) {
+	return currentModeToHAP(d.state.CurrMode.Status)
+}
+
+func (d *EmulatedDevice) TargetMode() (int, error) {
+	return targetModeToHAP(d.state.TargetMode.Mode)
+}
+
 func (d *EmulatedDevice) SetTargetMode(n int) error {
-	switch n {
-	case 0:
-		return d.SetMode(OFF)
-	case 1:
-		return d.SetMode(HEAT)
-	case 2:
-		return d.SetMode(COOL)
-	case 3:
-		return d.SetMode(HEATCOOL)
-	default:
-		// TODO handle error
-		panic("unreachable target mode enumeration")
+	mode, err := targetModeFromHAP(n)
+	if err != nil {
+		return err
 	}
+
+	return d.SetMode(mode)
 }
 
 func (d *EmulatedDevice) SetTargetTemp(t float64) error {
@@ -288,40 +525,29 @@ func (d *EmulatedDevice) SetTargetTemp(t float64) error {
 	case HEAT:
 		return d.SetHeat(t)
 	case HEATCOOL:
-		return d.SetHeatCool(t-2.5, t+2.5)
+		// the range is edited through the threshold characteristics, a
+		// single target temperature only shifts it
+		half := (d.state.TargetTemp.CoolCelsius - d.state.TargetTemp.HeatCelsius) / 2.0
+		return d.SetHeatCool(t-half, t+half)
 	default:
-		// TODO handle error
-		panic("unreachable target mode when setting target temp")
+		return &UnknownEnumError{Enum: "ThermostatMode", Value: d.state.TargetMode.Mode}
 	}
 }
 
-func (d *EmulatedDevice) DisplayUnit() int {
-	unit := d.state.DisplayUnit.Unit
-	switch unit {
-	case "CELSIUS":
-		return 0
-	case "FAHRENHEIT":
-		return 1
-	default:
-		panic("unreachable unit")
-	}
+func (d *EmulatedDevice) DisplayUnit() (int, error) {
+	return displayUnitToHAP(d.state.DisplayUnit.Unit)
 }
 
-func (d *EmulatedDevice) ListenEvents() error {
-	// create a pubsub client
-	ctx := context.Background()
+// UnknownEnums returns the number of unknown enumeration values the device
+// has reported
+func (d *EmulatedDevice) UnknownEnums() int {
+	return d.enums.Total()
+}
 
-	for {
-		_ = d.sub.Receive(ctx, func(ctx context.Context, m *pubsub.Message) {
-			var update PubsubUpdate
-			if err := json.Unmarshal(m.Data, &update); err != nil {
-				log.Println("Error decoding pubsub update:", err)
-				m.Nack()
-			}
-			d.UpdateTraits(update)
-			m.Ack()
-		})
-	}
+// readFailed reports an error of a HomeKit read and returns the HAP status
+func (d *EmulatedDevice) readFailed(err error) int {
+	d.enums.report(d.Name, err)
+	return hap.JsonStatusServiceCommunicationFailure
 }
 
 func (d *EmulatedDevice) ForceUpdate() error {
@@ -347,12 +573,19 @@ func (d *EmulatedDevice) UpdateTraits(t PubsubUpdate) {
 	d.Lock()
 	defer d.Unlock()
 
+	// every trait keeps the timestamp of the update it was last set by, so
+	// that out of order updates can't overwrite newer values
 	ts := t.Timestamp
-	if sDiff(t.ResourceUpdate.Traits.CurrMode.Status, d.state.CurrMode.Status) && ts.After(d.state.CurrMode.Timestamp) {
-		d.state.CurrMode.Status = t.ResourceUpdate.Traits.CurrMode.Status
-		d.state.CurrMode.Timestamp = ts
+	tr := t.ResourceUpdate.Traits
 
-		if err := d.CurrentHeatingCoolingState.SetValue(d.CurrentMode()); err != nil {
+	if newerString(tr.Connectivity.Status, ts, &d.state.Connectivity.Status, &d.state.Connectivity.Timestamp) {
+		log.Println("Nest: Connectivity updated to", d.state.Connectivity.Status)
+	}
+
+	if newerString(tr.CurrMode.Status, ts, &d.state.CurrMode.Status, &d.state.CurrMode.Timestamp) {
+		if mode, err := d.CurrentMode(); err != nil {
+			d.enums.report(d.Name, err)
+		} else if err := d.CurrentHeatingCoolingState.SetValue(mode); err != nil {
 			log.Println("Nest: Error updating current mode:", err)
 			return
 		}
@@ -360,20 +593,16 @@ func (d *EmulatedDevice) UpdateTraits(t PubsubUpdate) {
 		log.Println("Nest: Current mode updated to", d.state.CurrMode.Status)
 	}
 
-	if fDiff(t.ResourceUpdate.Traits.CurrTemp.TempCelsius, d.state.CurrTemp.TempCelsius) && ts.After(d.state.CurrTemp.Timestamp) {
-		d.state.CurrTemp.TempCelsius = t.ResourceUpdate.Traits.CurrTemp.TempCelsius
-		d.state.CurrTemp.Timestamp = ts
-
+	if newerFloat(tr.CurrTemp.TempCelsius, ts, &d.state.CurrTemp.TempCelsius, &d.state.CurrTemp.Timestamp) {
 		d.CurrentTemperature.SetValue(d.CurrentTemp())
 
 		log.Println("Nest: Current temperature updated to", d.state.CurrTemp.TempCelsius)
 	}
 
-	if sDiff(t.ResourceUpdate.Traits.DisplayUnit.Unit, d.state.DisplayUnit.Unit) && ts.After(d.state.DisplayUnit.Timestamp) {
-		d.state.DisplayUnit.Unit = t.ResourceUpdate.Traits.DisplayUnit.Unit
-		d.state.DisplayUnit.Timestamp = ts
-
-		if err := d.TemperatureDisplayUnits.SetValue(d.DisplayUnit()); err != nil {
+	if newerString(tr.DisplayUnit.Unit, ts, &d.state.DisplayUnit.Unit, &d.state.DisplayUnit.Timestamp) {
+		if unit, err := d.DisplayUnit(); err != nil {
+			d.enums.report(d.Name, err)
+		} else if err := d.TemperatureDisplayUnits.SetValue(unit); err != nil {
 			log.Println("Nest: Error updating display units:", err)
 			return
 		}
@@ -381,51 +610,120 @@ func (d *EmulatedDevice) UpdateTraits(t PubsubUpdate) {
 		log.Println("Nest: Display unit updated to", d.state.DisplayUnit.Unit)
 	}
 
-	// TODO(nateinaction): Add support for humidity
-	// if t.ResourceUpdate.Traits.Humidity.Percent != 0 && ts.After(d.state.Humidity.Timestamp) {
-	// 	d.state.Humidity.Percent = t.ResourceUpdate.Traits.Humidity.Percent
-	// 	d.state.Humidity.Timestamp = ts
-	// 	d.CurrentRelativeHumidity.SetValue(d.Humidity())
-	// 	log.Println("Humidity updated to", d.state.Humidity.Percent)
-	// }
+	if newerFloat(tr.Humidity.Percent, ts, &d.state.Humidity.Percent, &d.state.Humidity.Timestamp) {
+		d.CurrentRelativeHumidity.SetValue(d.Humidity())
 
-	if sDiff(t.ResourceUpdate.Traits.TargetMode.Mode, d.state.TargetMode.Mode) && ts.After(d.state.TargetMode.Timestamp) {
-		d.state.TargetMode.Mode = t.ResourceUpdate.Traits.TargetMode.Mode
-		d.state.TargetMode.Timestamp = ts
+		log.Println("Nest: Humidity updated to", d.state.Humidity.Percent)
+	}
 
-		if err := d.TargetHeatingCoolingState.SetValue(d.TargetMode()); err != nil {
-			log.Println("Nest: Error updating target mode:", err)
-			return
+	if newerString(tr.TargetMode.Mode, ts, &d.state.TargetMode.Mode, &d.state.TargetMode.Timestamp) {
+		if mode, err := d.TargetMode(); err != nil {
+			d.enums.report(d.Name, err)
+		} else {
+			if err := d.TargetHeatingCoolingState.SetValue(mode); err != nil {
+				log.Println("Nest: Error updating target mode:", err)
+				return
+			}
+
+			// the target temperature depends on the mode
+			d.updateSetpoints()
 		}
 
 		log.Println("Nest: Target mode updated to", d.state.TargetMode.Mode)
 	}
 
-	if fDiff(t.ResourceUpdate.Traits.TargetTemp.CoolCelsius, d.state.TargetTemp.CoolCelsius) && ts.After(d.state.TargetTemp.CoolTimestamp) {
-		d.state.TargetTemp.CoolCelsius = t.ResourceUpdate.Traits.TargetTemp.CoolCelsius
-		d.state.TargetTemp.CoolTimestamp = ts
-
-		d.TargetTemperature.SetValue(d.TargetTemp())
+	if newerFloat(tr.TargetTemp.CoolCelsius, ts, &d.state.TargetTemp.CoolCelsius, &d.state.TargetTemp.CoolTimestamp) {
+		d.updateSetpoints()
 
 		log.Println("Nest: Target cool temperature updated to", d.state.TargetTemp.CoolCelsius)
 	}
 
-	if fDiff(t.ResourceUpdate.Traits.TargetTemp.HeatCelsius, d.state.TargetTemp.HeatCelsius) && ts.After(d.state.TargetTemp.HeatTimestamp) {
-		d.state.TargetTemp.HeatCelsius = t.ResourceUpdate.Traits.TargetTemp.HeatCelsius
-		d.state.TargetTemp.HeatTimestamp = ts
-
-		d.TargetTemperature.SetValue(d.TargetTemp())
+	if newerFloat(tr.TargetTemp.HeatCelsius, ts, &d.state.TargetTemp.HeatCelsius, &d.state.TargetTemp.HeatTimestamp) {
+		d.updateSetpoints()
 
 		log.Println("Nest: Target heat temperature updated to", d.state.TargetTemp.HeatCelsius)
 	}
+
+	if newerString(tr.Eco.Mode, ts, &d.state.Eco.Mode, &d.state.Eco.Timestamp) {
+		if d.Eco != nil {
+			d.Eco.On.SetValue(d.EcoActive())
+		}
+
+		d.updateSetpoints()
+
+		log.Println("Nest: Eco mode updated to", d.state.Eco.Mode)
+	}
+
+	if newerFloat(tr.Eco.CoolCelsius, ts, &d.state.Eco.CoolCelsius, &d.state.Eco.CoolTimestamp) {
+		d.updateSetpoints()
+
+		log.Println("Nest: Eco cool temperature updated to", d.state.Eco.CoolCelsius)
+	}
+
+	if newerFloat(tr.Eco.HeatCelsius, ts, &d.state.Eco.HeatCelsius, &d.state.Eco.HeatTimestamp) {
+		d.updateSetpoints()
+
+		log.Println("Nest: Eco heat temperature updated to", d.state.Eco.HeatCelsius)
+	}
+
+	if d.Fan != nil && newerString(tr.Fan.TimerMode, ts, &d.state.Fan.TimerMode, &d.state.Fan.Timestamp) {
+		if err := d.Fan.Active.SetValue(d.FanActive()); err != nil {
+			log.Println("Nest: Error updating fan:", err)
+			return
+		}
+
+		log.Println("Nest: Fan timer mode updated to", d.state.Fan.TimerMode)
+	}
+}
+
+// updateSetpoints publishes the setpoints in effect to HomeKit
+func (d *EmulatedDevice) updateSetpoints() {
+	heat, cool := d.Setpoints()
+
+	if temp, err := d.TargetTemp(); err != nil {
+		d.enums.report(d.Name, err)
+	} else {
+		d.TargetTemperature.SetValue(temp)
+	}
+
+	d.HeatingThresholdTemperature.SetValue(heat)
+	d.CoolingThresholdTemperature.SetValue(cool)
 }
 
-// fDiff returns true if the floats are different and the new float is non-zero
-func fDiff(new, old float64) bool {
-	return new != 0 && new != old
+// newerString sets cur to v if v is present and ts is newer than at, the
+// timestamp of cur. It returns true if cur changed.
+func newerString(v *string, ts time.Time, cur *string, at *time.Time) bool {
+	if v == nil || !ts.After(*at) {
+		return false
+	}
+
+	// the timestamp moves on even if the value is the same, a late update
+	// setting another value is still older
+	*at = ts
+
+	if *v == *cur {
+		return false
+	}
+
+	*cur = *v
+
+	return true
 }
 
-// sDiff returns true if the strings are different and the new string is non-empty
-func sDiff(new, old string) bool {
-	return new != "" && new != old
+// newerFloat sets cur to v if v is present and ts is newer than at, the
+// timestamp of cur. It returns true if cur changed.
+func newerFloat(v *float64, ts time.Time, cur *float64, at *time.Time) bool {
+	if v == nil || !ts.After(*at) {
+		return false
+	}
+
+	*at = ts
+
+	if *v == *cur {
+		return false
+	}
+
+	*cur = *v
+
+	return true
 }
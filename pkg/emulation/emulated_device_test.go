@@ -0,0 +1,465 @@
+package emulation
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/brutella/hap"
+	"github.com/brutella/hap/characteristic"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/yangl1996/nesthub/internal/config"
+	"github.com/yangl1996/nesthub/pkg/sdmclient"
+	"github.com/yangl1996/nesthub/pkg/sdmfake"
+	"google.golang.org/api/option"
+	sdm "google.golang.org/api/smartdevicemanagement/v1"
+)
+
+// newTestThermostat emulates a thermostat in heat mode backed by a fake
+func newTestThermostat(t *testing.T) (*EmulatedDevice, *sdmclient.Fake) {
+	t.Helper()
+
+	fake := &sdmclient.Fake{}
+	fake.Traits.Connectivity.Status = sdmclient.String(ONLINE)
+	fake.Traits.CurrMode.Status = sdmclient.String(HEATING)
+	fake.Traits.CurrTemp.TempCelsius = sdmclient.Float(19.5)
+	fake.Traits.DisplayUnit.Unit = sdmclient.String(CELSIUS)
+	fake.Traits.Humidity.Percent = sdmclient.Float(40)
+	fake.Traits.TargetMode.Mode = sdmclient.String(HEAT)
+	fake.Traits.TargetTemp.HeatCelsius = sdmclient.Float(21)
+	fake.Traits.Eco.Mode = sdmclient.String(OFF)
+	fake.Traits.Eco.HeatCelsius = sdmclient.Float(15)
+	fake.Traits.Eco.CoolCelsius = sdmclient.Float(28)
+	fake.Traits.Fan.TimerMode = sdmclient.String(OFF)
+
+	d := &sdm.GoogleHomeEnterpriseSdmV1Device{
+		Name:   "enterprises/project/devices/thermostat",
+		Type:   TypeThermostat,
+		Traits: []byte(`{"sdm.devices.traits.Fan": {}, "sdm.devices.traits.ThermostatEco": {}}`),
+	}
+
+	e, err := newEmulatedDevice(fake, d, &config.Config{FanDuration: "15m"})
+	require.NoError(t, err)
+
+	return e, fake
+}
+
+// traitUpdate returns a pubsub update at ts with the traits set by set
+func traitUpdate(ts time.Time, set func(*sdmclient.DeviceTraits)) PubsubUpdate {
+	u := PubsubUpdate{Timestamp: ts}
+	set(&u.ResourceUpdate.Traits)
+
+	return u
+}
+
+func TestNewEmulatedDevice(t *testing.T) {
+	t.Parallel()
+
+	t.Run("initial state", func(t *testing.T) {
+		t.Parallel()
+		e, _ := newTestThermostat(t)
+
+		assert.Equal(t, 19.5, e.CurrentTemperature.Value())
+		assert.Equal(t, 40.0, e.CurrentRelativeHumidity.Value())
+		assert.Equal(t, 21.0, e.TargetTemperature.Value())
+		assert.Equal(t, characteristic.TargetHeatingCoolingStateHeat, e.TargetHeatingCoolingState.Value())
+		assert.Equal(t, characteristic.CurrentHeatingCoolingStateHeat, e.CurrentHeatingCoolingState.Value())
+		assert.False(t, e.Eco.On.Value())
+		assert.NotNil(t, e.Fan)
+	})
+
+	t.Run("without eco and fan traits", func(t *testing.T) {
+		t.Parallel()
+
+		fake := &sdmclient.Fake{}
+		fake.Traits.TargetMode.Mode = sdmclient.String(HEAT)
+		fake.Traits.TargetTemp.HeatCelsius = sdmclient.Float(21)
+
+		d := &sdm.GoogleHomeEnterpriseSdmV1Device{
+			Name:   "enterprises/project/devices/thermostat",
+			Type:   TypeThermostat,
+			Traits: []byte(`{"sdm.devices.traits.ThermostatMode": {}}`),
+		}
+
+		e, err := newEmulatedDevice(fake, d, &config.Config{FanDuration: "15m"})
+		require.NoError(t, err)
+
+		assert.Nil(t, e.Eco)
+		assert.Nil(t, e.Fan)
+		assert.Len(t, e.Accessory().Ss, 2)
+
+		// updates of the absent traits are still tracked
+		e.UpdateTraits(traitUpdate(time.Now(), func(tr *sdmclient.DeviceTraits) {
+			tr.Eco.Mode = sdmclient.String(ECO)
+			tr.Fan.TimerMode = sdmclient.String(ON)
+		}))
+
+		assert.True(t, e.EcoActive())
+	})
+
+	t.Run("device unreachable", func(t *testing.T) {
+		t.Parallel()
+
+		fake := &sdmclient.Fake{Err: errors.New("rate limited")}
+		d := &sdm.GoogleHomeEnterpriseSdmV1Device{Name: "enterprises/project/devices/thermostat"}
+
+		_, err := newEmulatedDevice(fake, d, &config.Config{})
+		assert.Error(t, err)
+	})
+}
+
+func TestUpdateTraits(t *testing.T) {
+	t.Parallel()
+
+	t.Run("newer update is applied", func(t *testing.T) {
+		t.Parallel()
+		e, _ := newTestThermostat(t)
+
+		e.UpdateTraits(traitUpdate(time.Now(), func(tr *sdmclient.DeviceTraits) {
+			tr.CurrTemp.TempCelsius = sdmclient.Float(20.5)
+			tr.TargetMode.Mode = sdmclient.String(COOL)
+			tr.TargetTemp.CoolCelsius = sdmclient.Float(24)
+		}))
+
+		assert.Equal(t, 20.5, e.CurrentTemperature.Value())
+		assert.Equal(t, characteristic.TargetHeatingCoolingStateCool, e.TargetHeatingCoolingState.Value())
+		assert.Equal(t, 24.0, e.TargetTemperature.Value())
+	})
+
+	t.Run("older update is ignored", func(t *testing.T) {
+		t.Parallel()
+		e, _ := newTestThermostat(t)
+
+		e.UpdateTraits(traitUpdate(time.Now().Add(-time.Minute), func(tr *sdmclient.DeviceTraits) {
+			tr.CurrTemp.TempCelsius = sdmclient.Float(25)
+		}))
+
+		assert.Equal(t, 19.5, e.CurrentTemperature.Value())
+	})
+
+	t.Run("timestamps are kept per trait", func(t *testing.T) {
+		t.Parallel()
+		e, _ := newTestThermostat(t)
+		now := time.Now()
+
+		e.UpdateTraits(traitUpdate(now.Add(2*time.Second), func(tr *sdmclient.DeviceTraits) {
+			tr.CurrTemp.TempCelsius = sdmclient.Float(22)
+		}))
+
+		// older than the temperature update, but newer than the humidity
+		e.UpdateTraits(traitUpdate(now.Add(time.Second), func(tr *sdmclient.DeviceTraits) {
+			tr.CurrTemp.TempCelsius = sdmclient.Float(21)
+			tr.Humidity.Percent = sdmclient.Float(55)
+		}))
+
+		assert.Equal(t, 22.0, e.CurrentTemperature.Value())
+		assert.Equal(t, 55.0, e.CurrentRelativeHumidity.Value())
+	})
+
+	t.Run("eco setpoints take over", func(t *testing.T) {
+		t.Parallel()
+		e, _ := newTestThermostat(t)
+
+		e.UpdateTraits(traitUpdate(time.Now(), func(tr *sdmclient.DeviceTraits) {
+			tr.Eco.Mode = sdmclient.String(ECO)
+		}))
+
+		assert.True(t, e.Eco.On.Value())
+		assert.Equal(t, 15.0, e.TargetTemperature.Value())
+		assert.Equal(t, 15.0, e.HeatingThresholdTemperature.Value())
+	})
+
+	t.Run("heat cool target is the middle of the range", func(t *testing.T) {
+		t.Parallel()
+		e, _ := newTestThermostat(t)
+
+		e.UpdateTraits(traitUpdate(time.Now(), func(tr *sdmclient.DeviceTraits) {
+			tr.TargetMode.Mode = sdmclient.String(HEATCOOL)
+			tr.TargetTemp.HeatCelsius = sdmclient.Float(20)
+			tr.TargetTemp.CoolCelsius = sdmclient.Float(24)
+		}))
+
+		assert.Equal(t, characteristic.TargetHeatingCoolingStateAuto, e.TargetHeatingCoolingState.Value())
+		assert.Equal(t, 22.0, e.TargetTemperature.Value())
+		assert.Equal(t, 20.0, e.HeatingThresholdTemperature.Value())
+		assert.Equal(t, 24.0, e.CoolingThresholdTemperature.Value())
+	})
+
+	t.Run("unknown mode is counted", func(t *testing.T) {
+		t.Parallel()
+		e, _ := newTestThermostat(t)
+
+		e.UpdateTraits(traitUpdate(time.Now(), func(tr *sdmclient.DeviceTraits) {
+			tr.TargetMode.Mode = sdmclient.String("DEFROST")
+		}))
+
+		assert.Equal(t, 1, e.UnknownEnums())
+		assert.Equal(t, characteristic.TargetHeatingCoolingStateHeat, e.TargetHeatingCoolingState.Value())
+	})
+
+	t.Run("zero values are applied", func(t *testing.T) {
+		t.Parallel()
+		e, _ := newTestThermostat(t)
+
+		e.UpdateTraits(traitUpdate(time.Now(), func(tr *sdmclient.DeviceTraits) {
+			tr.CurrTemp.TempCelsius = sdmclient.Float(0)
+			tr.Humidity.Percent = sdmclient.Float(0)
+		}))
+
+		assert.Equal(t, 0.0, e.CurrentTemperature.Value())
+		assert.Equal(t, 0.0, e.CurrentRelativeHumidity.Value())
+	})
+
+	t.Run("absent traits are skipped", func(t *testing.T) {
+		t.Parallel()
+		e, _ := newTestThermostat(t)
+
+		var u PubsubUpdate
+		require.NoError(t, json.Unmarshal([]byte(`{
+			"eventId": "event",
+			"timestamp": "`+time.Now().UTC().Format(time.RFC3339Nano)+`",
+			"resourceUpdate": {
+				"name": "enterprises/project/devices/thermostat",
+				"traits": {
+					"sdm.devices.traits.ThermostatTemperatureSetpoint": {"heatCelsius": 22.5}
+				}
+			}
+		}`), &u))
+
+		assert.Nil(t, u.ResourceUpdate.Traits.CurrTemp.TempCelsius)
+		assert.Nil(t, u.ResourceUpdate.Traits.TargetTemp.CoolCelsius)
+
+		e.UpdateTraits(u)
+		assert.Equal(t, 22.5, e.TargetTemperature.Value())
+		assert.Equal(t, 19.5, e.CurrentTemperature.Value())
+		assert.Equal(t, characteristic.TargetHeatingCoolingStateHeat, e.TargetHeatingCoolingState.Value())
+	})
+
+	t.Run("offline device fails reads", func(t *testing.T) {
+		t.Parallel()
+		e, _ := newTestThermostat(t)
+
+		e.UpdateTraits(traitUpdate(time.Now(), func(tr *sdmclient.DeviceTraits) {
+			tr.Connectivity.Status = sdmclient.String(OFFLINE)
+		}))
+
+		_, code := e.CurrentTemperature.ValueRequestFunc(nil)
+		assert.Equal(t, hap.JsonStatusServiceCommunicationFailure, code)
+	})
+}
+
+func TestUpdateTraitsConverges(t *testing.T) {
+	t.Parallel()
+
+	start := time.Now()
+	at := func(s int) time.Time { return start.Add(time.Duration(s) * time.Second) }
+
+	// a recorded sequence of updates, with values set back and forth and
+	// updates carrying several traits
+	events := []PubsubUpdate{
+		traitUpdate(at(1), func(tr *sdmclient.DeviceTraits) { tr.TargetMode.Mode = sdmclient.String(HEATCOOL) }),
+		traitUpdate(at(2), func(tr *sdmclient.DeviceTraits) {
+			tr.TargetTemp.HeatCelsius = sdmclient.Float(19)
+			tr.TargetTemp.CoolCelsius = sdmclient.Float(24)
+		}),
+		traitUpdate(at(3), func(tr *sdmclient.DeviceTraits) { tr.CurrTemp.TempCelsius = sdmclient.Float(20) }),
+		traitUpdate(at(4), func(tr *sdmclient.DeviceTraits) { tr.TargetMode.Mode = sdmclient.String(HEAT) }),
+		traitUpdate(at(5), func(tr *sdmclient.DeviceTraits) {
+			tr.CurrTemp.TempCelsius = sdmclient.Float(20.5)
+			tr.CurrMode.Status = sdmclient.String(OFF)
+		}),
+		traitUpdate(at(6), func(tr *sdmclient.DeviceTraits) { tr.Eco.Mode = sdmclient.String(ECO) }),
+		traitUpdate(at(7), func(tr *sdmclient.DeviceTraits) { tr.TargetMode.Mode = sdmclient.String(HEATCOOL) }),
+		traitUpdate(at(8), func(tr *sdmclient.DeviceTraits) {
+			tr.Eco.Mode = sdmclient.String(OFF)
+			tr.TargetTemp.HeatCelsius = sdmclient.Float(21)
+		}),
+		traitUpdate(at(9), func(tr *sdmclient.DeviceTraits) { tr.CurrMode.Status = sdmclient.String(HEATING) }),
+		traitUpdate(at(10), func(tr *sdmclient.DeviceTraits) { tr.Humidity.Percent = sdmclient.Float(52) }),
+	}
+
+	// snapshot is the state of the device as seen by HomeKit and the emulation.
+	// The trait timestamps are left out, the initial ones differ per device.
+	type snapshot struct {
+		state                       thermostatState
+		current, target, heat, cool float64
+		humidity                    float64
+		targetMode, currentMode     int
+		eco                         bool
+	}
+
+	apply := func(t *testing.T, order []PubsubUpdate) snapshot {
+		t.Helper()
+		e, _ := newTestThermostat(t)
+
+		for _, u := range order {
+			e.UpdateTraits(u)
+		}
+
+		return snapshot{
+			state:       withoutTimestamps(e.state),
+			current:     e.CurrentTemperature.Value(),
+			target:      e.TargetTemperature.Value(),
+			heat:        e.HeatingThresholdTemperature.Value(),
+			cool:        e.CoolingThresholdTemperature.Value(),
+			humidity:    e.CurrentRelativeHumidity.Value(),
+			targetMode:  e.TargetHeatingCoolingState.Value(),
+			currentMode: e.CurrentHeatingCoolingState.Value(),
+			eco:         e.Eco.On.Value(),
+		}
+	}
+
+	want := apply(t, events)
+	assert.Equal(t, characteristic.TargetHeatingCoolingStateAuto, want.targetMode)
+	assert.Equal(t, 22.5, want.target)
+
+	rng := rand.New(rand.NewSource(1))
+
+	for i := 0; i < 200; i++ {
+		order := make([]PubsubUpdate, len(events))
+		for j, k := range rng.Perm(len(events)) {
+			order[j] = events[k]
+		}
+
+		if !assert.Equal(t, want, apply(t, order), "permutation %d", i) {
+			return
+		}
+	}
+}
+
+// withoutTimestamps returns the values of s
+func withoutTimestamps(s thermostatState) thermostatState {
+	s.Connectivity.Timestamp = time.Time{}
+	s.CurrMode.Timestamp = time.Time{}
+	s.CurrTemp.Timestamp = time.Time{}
+	s.DisplayUnit.Timestamp = time.Time{}
+	s.Humidity.Timestamp = time.Time{}
+	s.TargetMode.Timestamp = time.Time{}
+	s.TargetTemp.HeatTimestamp = time.Time{}
+	s.TargetTemp.CoolTimestamp = time.Time{}
+	s.Eco.Timestamp = time.Time{}
+	s.Eco.HeatTimestamp = time.Time{}
+	s.Eco.CoolTimestamp = time.Time{}
+	s.Fan.Timestamp = time.Time{}
+
+	return s
+}
+
+func TestSetTargetTemp(t *testing.T) {
+	t.Parallel()
+
+	t.Run("heat", func(t *testing.T) {
+		t.Parallel()
+		e, fake := newTestThermostat(t)
+
+		require.NoError(t, e.SetTargetTemp(22))
+		assert.Equal(t, sdmclient.Command{Name: "SetHeat", Args: []interface{}{22.0}}, fake.LastCommand())
+	})
+
+	t.Run("heat cool keeps the width of the range", func(t *testing.T) {
+		t.Parallel()
+		e, fake := newTestThermostat(t)
+
+		e.UpdateTraits(traitUpdate(time.Now(), func(tr *sdmclient.DeviceTraits) {
+			tr.TargetMode.Mode = sdmclient.String(HEATCOOL)
+			tr.TargetTemp.HeatCelsius = sdmclient.Float(20)
+			tr.TargetTemp.CoolCelsius = sdmclient.Float(24)
+		}))
+
+		require.NoError(t, e.SetTargetTemp(23))
+		assert.Equal(t, sdmclient.Command{Name: "SetHeatCool", Args: []interface{}{21.0, 25.0}}, fake.LastCommand())
+	})
+
+	t.Run("off sends nothing", func(t *testing.T) {
+		t.Parallel()
+		e, fake := newTestThermostat(t)
+
+		e.UpdateTraits(traitUpdate(time.Now(), func(tr *sdmclient.DeviceTraits) {
+			tr.TargetMode.Mode = sdmclient.String(OFF)
+		}))
+
+		require.NoError(t, e.SetTargetTemp(23))
+		assert.Empty(t, fake.Commands)
+	})
+}
+
+func TestThresholdWrites(t *testing.T) {
+	t.Parallel()
+
+	e, fake := newTestThermostat(t)
+
+	e.UpdateTraits(traitUpdate(time.Now(), func(tr *sdmclient.DeviceTraits) {
+		tr.TargetMode.Mode = sdmclient.String(HEATCOOL)
+		tr.TargetTemp.HeatCelsius = sdmclient.Float(20)
+		tr.TargetTemp.CoolCelsius = sdmclient.Float(24)
+	}))
+
+	// the Home app writes both thresholds of a moved range in one request
+	req := httptest.NewRequest(http.MethodPut, "/characteristics", nil)
+
+	_, status := e.HeatingThresholdTemperature.SetValueRequest(21.0, req)
+	require.Equal(t, 0, status)
+
+	_, status = e.CoolingThresholdTemperature.SetValueRequest(26.0, req)
+	require.Equal(t, 0, status)
+
+	assert.Equal(t, sdmclient.Command{Name: "SetHeatCool", Args: []interface{}{21.0, 26.0}}, fake.LastCommand())
+}
+
+func TestSetpointWritesInEco(t *testing.T) {
+	t.Parallel()
+
+	e, fake := newTestThermostat(t)
+
+	e.UpdateTraits(traitUpdate(time.Now(), func(tr *sdmclient.DeviceTraits) {
+		tr.Eco.Mode = sdmclient.String(ECO)
+	}))
+
+	req := httptest.NewRequest(http.MethodPut, "/characteristics", nil)
+
+	for _, c := range []*characteristic.C{e.TargetTemperature.C, e.HeatingThresholdTemperature.C, e.CoolingThresholdTemperature.C} {
+		_, status := c.SetValueRequest(25.0, req)
+		assert.Equal(t, statusNotAllowedInCurrentState, status)
+	}
+
+	assert.Empty(t, fake.Commands)
+	assert.Equal(t, 15.0, e.TargetTemperature.Value())
+}
+
+func TestEmulatedDeviceWithSDMServer(t *testing.T) {
+	t.Parallel()
+
+	th := sdmfake.NewThermostat("one")
+	th.CustomName = "Hallway"
+
+	srv := sdmfake.NewServer("project", th)
+	defer srv.Close()
+
+	s, err := sdm.NewService(context.Background(), option.WithEndpoint(srv.URL+"/"), option.WithoutAuthentication())
+	require.NoError(t, err)
+
+	resp, err := s.Enterprises.Devices.List("enterprises/project").Do()
+	require.NoError(t, err)
+	require.Len(t, resp.Devices, 1)
+
+	e, err := newEmulatedDevice(&sdmclient.DeviceEndpoint{Service: s, Name: resp.Devices[0].Name}, resp.Devices[0], &config.Config{FanDuration: "15m"})
+	require.NoError(t, err)
+
+	assert.Equal(t, "Hallway", e.Accessory().Info.Name.Value())
+	assert.InDelta(t, 18.0, e.CurrentTemperature.Value(), 0.01)
+	assert.Equal(t, 20.0, e.TargetTemperature.Value())
+	assert.NotNil(t, e.Fan)
+
+	require.NoError(t, e.SetTargetTemp(21))
+	require.NoError(t, e.ForceUpdate())
+	assert.Equal(t, 21.0, e.TargetTemperature.Value())
+
+	// cooling setpoints are refused in heat mode
+	assert.Error(t, e.SetCool(25))
+}
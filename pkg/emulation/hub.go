@@ -0,0 +1,366 @@
+package emulation
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"github.com/brutella/hap/accessory"
+	"github.com/yangl1996/nesthub/internal/config"
+	"github.com/yangl1996/nesthub/pkg/sdmclient"
+	"google.golang.org/api/option"
+	sdm "google.golang.org/api/smartdevicemanagement/v1"
+)
+
+// SDM device types, see https://developers.google.com/nest/device-access/api
+const (
+	TypeThermostat = "sdm.devices.types.THERMOSTAT"
+	TypeCamera     = "sdm.devices.types.CAMERA"
+	TypeDoorbell   = "sdm.devices.types.DOORBELL"
+	TypeDisplay    = "sdm.devices.types.DISPLAY"
+)
+
+// backoff between attempts to receive from the pubsub subscription
+const (
+	receiveBackoffMin = time.Second
+	receiveBackoffMax = 2 * time.Minute
+)
+
+// Device is an SDM device emulated as a HomeKit accessory
+type Device interface {
+	// Accessory returns the HomeKit accessory of the device
+	Accessory() *accessory.A
+
+	// UpdateTraits applies a resource update received from pubsub
+	UpdateTraits(PubsubUpdate)
+
+	// Reconfigure applies the live fields of a reloaded config
+	Reconfigure(c *config.Config)
+}
+
+// DeviceHandler creates the emulation of an SDM device of the type it is
+// registered for.
+type DeviceHandler func(s *sdm.Service, d *sdm.GoogleHomeEnterpriseSdmV1Device) (Device, error)
+
+// Hub owns the pubsub subscription of the SDM enterprise and routes the
+// resource updates to the emulated device they belong to.
+type Hub struct {
+	sub      *pubsub.Subscription
+	handlers map[string]DeviceHandler
+	devices  map[string]Device
+	order    []string
+	seen     *eventLRU
+
+	// budget is the SDM API request budget shared by all devices
+	budget *requestBudget
+
+	// resync asks for a poll of all devices, e.g. once pubsub works again
+	// after failing
+	resync chan struct{}
+}
+
+// polledDevice is a Device whose state can be fetched from the SDM API
+type polledDevice interface {
+	Device
+
+	// ForceUpdate fetches the state of the device and applies it
+	ForceUpdate() error
+}
+
+// defaultHandlers returns the device handlers of all supported device types.
+// The SDM API requests of the devices share budget.
+func defaultHandlers(c *config.Config, budget *requestBudget) map[string]DeviceHandler {
+	return map[string]DeviceHandler{
+		TypeThermostat: func(s *sdm.Service, d *sdm.GoogleHomeEnterpriseSdmV1Device) (Device, error) {
+			client := &budgetedDevice{
+				Device:  &sdmclient.DeviceEndpoint{Service: s, Name: d.Name},
+				budget:  budget,
+				timeout: budgetWaitTimeout,
+			}
+
+			return newEmulatedDevice(client, d, c)
+		},
+		TypeCamera: func(s *sdm.Service, d *sdm.GoogleHomeEnterpriseSdmV1Device) (Device, error) {
+			return NewEmulatedCamera(d, c)
+		},
+		TypeDoorbell: func(s *sdm.Service, d *sdm.GoogleHomeEnterpriseSdmV1Device) (Device, error) {
+			return NewEmulatedCamera(d, c)
+		},
+	}
+}
+
+// NewHub emulates the devices of the SDM enterprise and listens to their
+// pubsub updates until ctx is done
+func NewHub(ctx context.Context, c *config.Config) (*Hub, error) {
+	// Setup sdm service
+	tokenSource, err := c.NewOAuthTokenSource(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get oauth token source: %w", err)
+	}
+
+	s, err := sdm.NewService(ctx, option.WithTokenSource(tokenSource))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create sdm service: %w", err)
+	}
+
+	// list the devices
+	resp, err := ListDevicesWithRetries(ctx, s, c)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Println("Retrieved", len(resp.Devices), "devices")
+
+	// create pubsub client and subscription
+	pc, err := c.NewPubsubClient(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create pubsub client: %w", err)
+	}
+
+	budget := newRequestBudget(sdmBudgetInterval, sdmBudgetBurst)
+
+	h := newHub(pc.Subscription(c.PubsubSubscription), budget, defaultHandlers(c, budget))
+	if err := h.addDevices(s, resp.Devices); err != nil {
+		return nil, err
+	}
+
+	// start updating the states through pubsub until ctx is done, and poll
+	// them to recover from missed events
+	go h.ListenEvents(ctx)
+	go h.Reconcile(ctx, c.PollIntervalDuration())
+
+	return h, nil
+}
+
+// newHub returns a hub without devices routing the updates of sub. Its polls
+// draw from budget.
+func newHub(sub *pubsub.Subscription, budget *requestBudget, handlers map[string]DeviceHandler) *Hub {
+	return &Hub{
+		sub:      sub,
+		handlers: handlers,
+		devices:  make(map[string]Device),
+		seen:     newEventLRU(seenEventsSize),
+		budget:   budget,
+		resync:   make(chan struct{}, 1),
+	}
+}
+
+// ListDevicesWithRetries lists the devices of the SDM enterprise, retrying
+// with exponential backoff until it succeeds or ctx is done
+func ListDevicesWithRetries(ctx context.Context, s *sdm.Service, c *config.Config) (*sdm.GoogleHomeEnterpriseSdmV1ListDevicesResponse, error) {
+	delay := 1
+	delayMultiplier := 2
+	delayMax := 120
+
+	for {
+		resp, err := s.Enterprises.Devices.List("enterprises/" + c.SDMProjectID).Context(ctx).Do()
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("failed to list devices: %w", ctx.Err())
+		}
+
+		if err != nil {
+			delayDuration := time.Duration(delay) * time.Second
+			log.Printf("Failed to connect to SDM API, retrying in %s: %v", delayDuration, err)
+
+			if err := sleep(ctx, delayDuration); err != nil {
+				return nil, fmt.Errorf("failed to list devices: %w", err)
+			}
+
+			delay *= delayMultiplier
+			if delay > delayMax {
+				delay = delayMax
+			}
+
+			continue
+		}
+
+		return resp, nil
+	}
+}
+
+// addDevices passes each device to the handler registered for its type.
+// Devices of unsupported types are skipped.
+func (h *Hub) addDevices(s *sdm.Service, devices []*sdm.GoogleHomeEnterpriseSdmV1Device) error {
+	for _, d := range devices {
+		handler, ok := h.handlers[d.Type]
+		if !ok {
+			log.Printf("Skipping device %s of unsupported type %s", d.Name, d.Type)
+			continue
+		}
+
+		log.Println("Controlling device", d.Name, "of type", d.Type)
+
+		e, err := handler(s, d)
+		if err != nil {
+			return fmt.Errorf("failed to emulate device %s: %w", d.Name, err)
+		}
+
+		h.devices[d.Name] = e
+		h.order = append(h.order, d.Name)
+	}
+
+	return nil
+}
+
+// Accessories returns the HomeKit accessories of all emulated devices, in the
+// order the SDM API listed them.
+func (h *Hub) Accessories() []*accessory.A {
+	as := make([]*accessory.A, 0, len(h.order))
+	for _, name := range h.order {
+		as = append(as, h.devices[name].Accessory())
+	}
+
+	return as
+}
+
+// Reconfigure passes a reloaded config to all emulated devices
+func (h *Hub) Reconfigure(c *config.Config) {
+	for _, name := range h.order {
+		h.devices[name].Reconfigure(c)
+	}
+}
+
+// ListenEvents routes the pubsub updates to the devices until ctx is done.
+// Receive errors, e.g. after the subscription was deleted or the credentials
+// expired, are logged and retried with exponential backoff. Once a retry
+// delivers a message, all devices are polled to recover the events that
+// expired while receiving failed.
+func (h *Hub) ListenEvents(ctx context.Context) {
+	delay := receiveBackoffMin
+	failed := false
+
+	for {
+		var received int32
+
+		err := h.sub.Receive(ctx, func(ctx context.Context, m *pubsub.Message) {
+			if atomic.CompareAndSwapInt32(&received, 0, 1) && failed {
+				h.requestResync()
+			}
+
+			h.handleMessage(m)
+		})
+		if ctx.Err() != nil {
+			return
+		}
+
+		// the subscription worked for a while before failing, start over
+		if atomic.LoadInt32(&received) == 1 {
+			delay = receiveBackoffMin
+		}
+
+		failed = true
+
+		log.Printf("Failed to receive pubsub events, retrying in %s: %v", delay, err)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+
+		delay *= 2
+		if delay > receiveBackoffMax {
+			delay = receiveBackoffMax
+		}
+	}
+}
+
+// requestResync asks Reconcile to poll all devices without waiting for the
+// interval. Requests made while one is pending are merged.
+func (h *Hub) requestResync() {
+	select {
+	case h.resync <- struct{}{}:
+	default:
+	}
+}
+
+// Reconcile polls the state of all devices every interval and whenever a
+// resync is requested, until ctx is done. The polls are applied like pubsub
+// updates at the time of the fetch, so newer events still take precedence.
+func (h *Hub) Reconcile(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-h.resync:
+			log.Println("Polling devices to recover events missed while receiving pubsub events failed")
+		}
+
+		h.pollDevices(ctx)
+	}
+}
+
+// pollDevices fetches the state of each device that has one, leaving part of
+// the request budget to commands from HomeKit
+func (h *Hub) pollDevices(ctx context.Context) {
+	for _, name := range h.order {
+		d, ok := h.devices[name].(polledDevice)
+		if !ok {
+			continue
+		}
+
+		if err := h.budget.WaitHeadroom(ctx, pollReserve+1); err != nil {
+			return
+		}
+
+		if err := d.ForceUpdate(); err != nil {
+			log.Printf("Failed to poll device %s: %v", name, err)
+		}
+	}
+}
+
+// handleMessage applies a pubsub message to the device it belongs to. Every
+// message is acked exactly once: a message that can't be decoded would fail
+// again on redelivery, so it is logged and dropped, as are events that were
+// already applied.
+func (h *Hub) handleMessage(m *pubsub.Message) {
+	var update PubsubUpdate
+	if err := json.Unmarshal(m.Data, &update); err != nil {
+		log.Printf("Dropping pubsub message %s that can't be decoded: %v", m.ID, err)
+		m.Ack()
+
+		return
+	}
+
+	if update.EventID != "" && h.seen.seen(update.EventID) {
+		log.Println("Dropping redelivered pubsub event", update.EventID)
+		m.Ack()
+
+		return
+	}
+
+	d, ok := h.devices[update.ResourceUpdate.Name]
+	if !ok {
+		log.Println("Ignoring pubsub update for unknown device", update.ResourceUpdate.Name)
+		m.Ack()
+
+		return
+	}
+
+	d.UpdateTraits(update)
+	m.Ack()
+}
+
+// accessoryID derives a stable HomeKit accessory ID from the SDM device name so
+// that accessories keep their identity across restarts regardless of the order
+// in which they are listed. ID 1 is reserved for the bridge.
+func accessoryID(name string) uint64 {
+	h := fnv.New32a()
+	h.Write([]byte(name)) //nolint:errcheck
+
+	id := uint64(h.Sum32())
+	if id < 2 {
+		id += 2
+	}
+
+	return id
+}
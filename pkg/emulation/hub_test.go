@@ -0,0 +1,370 @@
+package emulation
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"cloud.google.com/go/pubsub/pstest"
+	"github.com/brutella/hap/characteristic"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/yangl1996/nesthub/internal/config"
+	"github.com/yangl1996/nesthub/pkg/sdmclient"
+	"github.com/yangl1996/nesthub/pkg/sdmfake"
+	"google.golang.org/api/option"
+	sdm "google.golang.org/api/smartdevicemanagement/v1"
+)
+
+const (
+	testThermostat = "enterprises/project/devices/one"
+	testCamera     = "enterprises/project/devices/camera"
+)
+
+// testHub is a hub listening to a pstest pubsub server, with a thermostat
+// served by sdmfake and a camera
+type testHub struct {
+	*Hub
+	pc     *pubsub.Client
+	topic  *pubsub.Topic
+	sub    *pubsub.Subscription
+	ps     *pstest.Server
+	api    *sdmfake.Server
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// done is closed when ListenEvents returns
+	done chan struct{}
+}
+
+func newTestHub(t *testing.T) *testHub {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	ps := pstest.NewServer()
+	t.Cleanup(func() { ps.Close() })
+
+	api := sdmfake.NewServer("project", sdmfake.NewThermostat("one"))
+	t.Cleanup(api.Close)
+
+	c := &config.Config{
+		GCPProjectID:       "gcp",
+		PubsubSubscription: "nesthub",
+		PubsubEmulatorHost: ps.Addr,
+		FanDuration:        "15m",
+		SensorHoldTime:     "1m",
+	}
+
+	pc, err := c.NewPubsubClient(ctx)
+	require.NoError(t, err)
+	t.Cleanup(func() { pc.Close() })
+
+	topic, err := pc.CreateTopic(ctx, "sdm-events")
+	require.NoError(t, err)
+
+	sub, err := pc.CreateSubscription(ctx, c.PubsubSubscription, pubsub.SubscriptionConfig{Topic: topic})
+	require.NoError(t, err)
+
+	s, err := sdm.NewService(ctx, option.WithEndpoint(api.URL+"/"), option.WithoutAuthentication())
+	require.NoError(t, err)
+
+	resp, err := s.Enterprises.Devices.List("enterprises/project").Do()
+	require.NoError(t, err)
+
+	camera := &sdm.GoogleHomeEnterpriseSdmV1Device{
+		Name:   testCamera,
+		Type:   TypeCamera,
+		Traits: []byte(`{"sdm.devices.traits.CameraMotion": {}, "sdm.devices.traits.CameraPerson": {}}`),
+	}
+
+	budget := newRequestBudget(sdmBudgetInterval, sdmBudgetBurst)
+
+	h := newHub(sub, budget, defaultHandlers(c, budget))
+	require.NoError(t, h.addDevices(s, append(resp.Devices, camera)))
+
+	th := &testHub{Hub: h, pc: pc, topic: topic, sub: sub, ps: ps, api: api, ctx: ctx, cancel: cancel, done: make(chan struct{})}
+
+	go func() {
+		h.ListenEvents(ctx)
+		close(th.done)
+	}()
+
+	return th
+}
+
+// publish sends an SDM event message as the SDM API would
+func (h *testHub) publish(t *testing.T, event string) {
+	t.Helper()
+
+	_, err := h.topic.Publish(context.Background(), &pubsub.Message{Data: []byte(event)}).Get(context.Background())
+	require.NoError(t, err)
+}
+
+// sdmEvent returns the JSON of the SDM resource update id of device at ts
+func sdmEvent(t *testing.T, id, device string, ts time.Time, update string) string {
+	t.Helper()
+
+	b, err := json.Marshal(map[string]interface{}{
+		"eventId":        id,
+		"timestamp":      ts.UTC().Format(time.RFC3339Nano),
+		"resourceUpdate": json.RawMessage(`{"name": "` + device + `", ` + update + `}`),
+		"userId":         "AVPHwEuBfnPOnTqzVFT4IONX2Qqhu9EJ4ubO-bNnQ-yi",
+		"resourceGroup":  []string{device},
+	})
+	require.NoError(t, err)
+
+	return string(b)
+}
+
+func TestHubEvents(t *testing.T) {
+	t.Parallel()
+
+	t.Run("thermostat traits", func(t *testing.T) {
+		t.Parallel()
+		h := newTestHub(t)
+		d := h.devices[testThermostat].(*EmulatedDevice)
+
+		h.publish(t, sdmEvent(t, "event-1", testThermostat, time.Now(), `"traits": {
+			"sdm.devices.traits.Temperature": {"ambientTemperatureCelsius": 23.5},
+			"sdm.devices.traits.ThermostatMode": {"mode": "COOL", "availableModes": ["HEAT", "COOL", "HEATCOOL", "OFF"]},
+			"sdm.devices.traits.ThermostatTemperatureSetpoint": {"coolCelsius": 22.0}
+		}`))
+
+		assert.Eventually(t, func() bool {
+			return d.CurrentTemperature.Value() == 23.5 &&
+				d.TargetHeatingCoolingState.Value() == characteristic.TargetHeatingCoolingStateCool &&
+				d.TargetTemperature.Value() == 22.0
+		}, 5*time.Second, 10*time.Millisecond)
+	})
+
+	t.Run("camera motion", func(t *testing.T) {
+		t.Parallel()
+		h := newTestHub(t)
+		c := h.devices[testCamera].(*EmulatedCamera)
+
+		h.publish(t, sdmEvent(t, "event-2", testCamera, time.Now(), `"events": {
+			"sdm.devices.events.CameraMotion.Motion": {
+				"eventSessionId": "CjY5Y3VKaTZwR3o4Y19YbTVfMF...",
+				"eventId": "n:1"
+			}
+		}`))
+
+		assert.Eventually(t, c.Motion.MotionDetected.Value, 5*time.Second, 10*time.Millisecond)
+		assert.Equal(t, characteristic.OccupancyDetectedOccupancyNotDetected, c.Person.OccupancyDetected.Value())
+	})
+
+	t.Run("unknown device is ignored", func(t *testing.T) {
+		t.Parallel()
+		h := newTestHub(t)
+		d := h.devices[testThermostat].(*EmulatedDevice)
+
+		h.publish(t, sdmEvent(t, "event-3", "enterprises/project/devices/other", time.Now(), `"traits": {
+			"sdm.devices.traits.Temperature": {"ambientTemperatureCelsius": 30.0}
+		}`))
+		h.publish(t, sdmEvent(t, "event-4", testThermostat, time.Now(), `"traits": {
+			"sdm.devices.traits.Humidity": {"ambientHumidityPercent": 61.0}
+		}`))
+
+		assert.Eventually(t, func() bool {
+			return d.CurrentRelativeHumidity.Value() == 61.0
+		}, 5*time.Second, 10*time.Millisecond)
+		assert.InDelta(t, 18.0, d.CurrentTemperature.Value(), 0.01)
+	})
+}
+
+func TestListenEvents(t *testing.T) {
+	t.Parallel()
+
+	t.Run("malformed message is acked once", func(t *testing.T) {
+		t.Parallel()
+		h := newTestHub(t)
+
+		h.publish(t, "not json")
+
+		assert.Eventually(t, func() bool {
+			msgs := h.ps.Messages()
+			return len(msgs) == 1 && msgs[0].Acks == 1
+		}, 5*time.Second, 10*time.Millisecond)
+
+		// give a redelivery the chance to happen
+		time.Sleep(100 * time.Millisecond)
+		assert.Equal(t, 1, h.ps.Messages()[0].Deliveries)
+	})
+
+	t.Run("stops when the context is done", func(t *testing.T) {
+		t.Parallel()
+		h := newTestHub(t)
+
+		h.cancel()
+
+		select {
+		case <-h.done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("ListenEvents did not return")
+		}
+	})
+
+	t.Run("stops while backing off", func(t *testing.T) {
+		t.Parallel()
+		h := newTestHub(t)
+
+		// receiving fails once the subscription is gone
+		require.NoError(t, h.sub.Delete(context.Background()))
+		time.Sleep(100 * time.Millisecond)
+
+		h.cancel()
+
+		select {
+		case <-h.done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("ListenEvents did not return")
+		}
+	})
+}
+
+func TestHubDropsRedeliveredEvents(t *testing.T) {
+	t.Parallel()
+	h := newTestHub(t)
+	d := h.devices[testThermostat].(*EmulatedDevice)
+	now := time.Now()
+
+	h.publish(t, sdmEvent(t, "event", testThermostat, now, `"traits": {
+		"sdm.devices.traits.Temperature": {"ambientTemperatureCelsius": 23.0}
+	}`))
+
+	assert.Eventually(t, func() bool {
+		return d.CurrentTemperature.Value() == 23.0
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// a redelivery must not be applied, even if it looks newer
+	h.publish(t, sdmEvent(t, "event", testThermostat, now.Add(time.Second), `"traits": {
+		"sdm.devices.traits.Temperature": {"ambientTemperatureCelsius": 25.0}
+	}`))
+	h.publish(t, sdmEvent(t, "next", testThermostat, now.Add(time.Second), `"traits": {
+		"sdm.devices.traits.Humidity": {"ambientHumidityPercent": 61.0}
+	}`))
+
+	assert.Eventually(t, func() bool {
+		return d.CurrentRelativeHumidity.Value() == 61.0
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, 23.0, d.CurrentTemperature.Value())
+}
+
+func TestReconcile(t *testing.T) {
+	t.Parallel()
+
+	t.Run("poll recovers missed events", func(t *testing.T) {
+		t.Parallel()
+		h := newTestHub(t)
+		d := h.devices[testThermostat].(*EmulatedDevice)
+
+		// changed without a pubsub event
+		h.api.Update(func(ts []*sdmfake.Thermostat) {
+			ts[0].Mode = "COOL"
+			ts[0].Ambient = 25
+		})
+
+		h.pollDevices(h.ctx)
+
+		assert.Equal(t, characteristic.TargetHeatingCoolingStateCool, d.TargetHeatingCoolingState.Value())
+		assert.InDelta(t, 25.0, d.CurrentTemperature.Value(), 0.01)
+	})
+
+	t.Run("newer events win over a poll", func(t *testing.T) {
+		t.Parallel()
+		h := newTestHub(t)
+		d := h.devices[testThermostat].(*EmulatedDevice)
+
+		d.UpdateTraits(traitUpdate(time.Now().Add(time.Minute), func(tr *sdmclient.DeviceTraits) {
+			tr.Humidity.Percent = sdmclient.Float(70)
+		}))
+
+		h.pollDevices(h.ctx)
+
+		assert.Equal(t, 70.0, d.CurrentRelativeHumidity.Value())
+	})
+
+	t.Run("resync once pubsub works again", func(t *testing.T) {
+		t.Parallel()
+		h := newTestHub(t)
+		d := h.devices[testThermostat].(*EmulatedDevice)
+
+		go h.Reconcile(h.ctx, time.Hour)
+
+		// receiving fails while the subscription is gone
+		require.NoError(t, h.sub.Delete(context.Background()))
+		time.Sleep(100 * time.Millisecond)
+
+		// changed while pubsub is down, the event expired
+		h.api.Update(func(ts []*sdmfake.Thermostat) { ts[0].Humidity = 33 })
+
+		_, err := h.pc.CreateSubscription(context.Background(), h.sub.ID(), pubsub.SubscriptionConfig{Topic: h.topic})
+		require.NoError(t, err)
+
+		h.publish(t, sdmEvent(t, "event-1", testThermostat, time.Now(), `"traits": {
+			"sdm.devices.traits.Temperature": {"ambientTemperatureCelsius": 23.0}
+		}`))
+
+		// the event is delivered after the backoff and triggers the poll
+		assert.Eventually(t, func() bool {
+			return d.CurrentRelativeHumidity.Value() == 33.0
+		}, 10*time.Second, 10*time.Millisecond)
+	})
+
+	t.Run("no resync while pubsub works", func(t *testing.T) {
+		t.Parallel()
+		h := newTestHub(t)
+		d := h.devices[testThermostat].(*EmulatedDevice)
+
+		go h.Reconcile(h.ctx, time.Hour)
+
+		h.api.Update(func(ts []*sdmfake.Thermostat) { ts[0].Humidity = 33 })
+
+		h.publish(t, sdmEvent(t, "event-1", testThermostat, time.Now(), `"traits": {
+			"sdm.devices.traits.Temperature": {"ambientTemperatureCelsius": 23.0}
+		}`))
+
+		assert.Eventually(t, func() bool {
+			return d.CurrentTemperature.Value() == 23.0
+		}, 5*time.Second, 10*time.Millisecond)
+		assert.Never(t, func() bool {
+			return d.CurrentRelativeHumidity.Value() == 33.0
+		}, 200*time.Millisecond, 10*time.Millisecond)
+	})
+}
+
+func TestListDevicesWithRetries(t *testing.T) {
+	t.Parallel()
+
+	api := sdmfake.NewServer("project", sdmfake.NewThermostat("one"))
+	t.Cleanup(api.Close)
+
+	s, err := sdm.NewService(context.Background(), option.WithEndpoint(api.URL+"/"), option.WithoutAuthentication())
+	require.NoError(t, err)
+
+	c := &config.Config{SDMProjectID: "project"}
+
+	t.Run("retries until the list succeeds", func(t *testing.T) {
+		api.FailNext(sdmfake.ErrRateLimited())
+
+		resp, err := ListDevicesWithRetries(context.Background(), s, c)
+		require.NoError(t, err)
+		assert.Len(t, resp.Devices, 1)
+	})
+
+	t.Run("gives up once the context is done", func(t *testing.T) {
+		api.FailNext(sdmfake.ErrRateLimited(), sdmfake.ErrRateLimited(), sdmfake.ErrRateLimited())
+
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+
+		start := time.Now()
+		_, err := ListDevicesWithRetries(ctx, s, c)
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+		assert.Less(t, time.Since(start), time.Second)
+	})
+}
@@ -0,0 +1,124 @@
+package emulation
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+
+	"github.com/brutella/hap/characteristic"
+)
+
+// UnknownEnumError is returned when an SDM or HomeKit enumeration value has no
+// counterpart on the other side
+type UnknownEnumError struct {
+	// Enum is the name of the enumeration, e.g. "ThermostatMode"
+	Enum string
+
+	// Value is the unmapped value
+	Value interface{}
+}
+
+func (e *UnknownEnumError) Error() string {
+	return fmt.Sprintf("unknown %s value %v", e.Enum, e.Value)
+}
+
+// enumCounter counts the unknown enumeration values seen by a device. Each
+// distinct value is logged once so that frequent HomeKit reads don't flood
+// the log.
+type enumCounter struct {
+	sync.Mutex
+	counts map[string]int
+	total  int
+}
+
+// report counts err if it is an UnknownEnumError
+func (c *enumCounter) report(device string, err error) {
+	var enumErr *UnknownEnumError
+	if !errors.As(err, &enumErr) {
+		return
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	if c.counts == nil {
+		c.counts = make(map[string]int)
+	}
+
+	key := enumErr.Error()
+	if c.counts[key] == 0 {
+		log.Printf("Nest: Device %s reported %s, please file an issue", device, key)
+	}
+
+	c.counts[key]++
+	c.total++
+}
+
+// Total returns the number of unknown enumeration values seen
+func (c *enumCounter) Total() int {
+	c.Lock()
+	defer c.Unlock()
+
+	return c.total
+}
+
+// targetModeToHAP maps an SDM ThermostatMode onto TargetHeatingCoolingState
+func targetModeToHAP(mode string) (int, error) {
+	switch mode {
+	case OFF:
+		return characteristic.TargetHeatingCoolingStateOff, nil
+	case HEAT:
+		return characteristic.TargetHeatingCoolingStateHeat, nil
+	case COOL:
+		return characteristic.TargetHeatingCoolingStateCool, nil
+	case HEATCOOL:
+		return characteristic.TargetHeatingCoolingStateAuto, nil
+	default:
+		return 0, &UnknownEnumError{Enum: "ThermostatMode", Value: mode}
+	}
+}
+
+// targetModeFromHAP maps a TargetHeatingCoolingState onto an SDM ThermostatMode
+func targetModeFromHAP(n int) (string, error) {
+	switch n {
+	case characteristic.TargetHeatingCoolingStateOff:
+		return OFF, nil
+	case characteristic.TargetHeatingCoolingStateHeat:
+		return HEAT, nil
+	case characteristic.TargetHeatingCoolingStateCool:
+		return COOL, nil
+	case characteristic.TargetHeatingCoolingStateAuto:
+		return HEATCOOL, nil
+	default:
+		return "", &UnknownEnumError{Enum: "TargetHeatingCoolingState", Value: n}
+	}
+}
+
+// currentModeToHAP maps an SDM ThermostatHvac status onto
+// CurrentHeatingCoolingState
+func currentModeToHAP(status string) (int, error) {
+	switch status {
+	case OFF:
+		return characteristic.CurrentHeatingCoolingStateOff, nil
+	case HEATING:
+		return characteristic.CurrentHeatingCoolingStateHeat, nil
+	case COOLING:
+		return characteristic.CurrentHeatingCoolingStateCool, nil
+	default:
+		return 0, &UnknownEnumError{Enum: "ThermostatHvac", Value: status}
+	}
+}
+
+// displayUnitToHAP maps an SDM Settings temperature scale onto
+// TemperatureDisplayUnits
+func displayUnitToHAP(unit string) (int, error) {
+	switch unit {
+	case CELSIUS:
+		return characteristic.TemperatureDisplayUnitsCelsius, nil
+	case FAHRENHEIT:
+		return characteristic.TemperatureDisplayUnitsFahrenheit, nil
+	default:
+		return 0, &UnknownEnumError{Enum: "TemperatureScale", Value: unit}
+	}
+}
@@ -0,0 +1,77 @@
+package emulation
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTargetModeMapping(t *testing.T) {
+	t.Parallel()
+
+	t.Run("round trip", func(t *testing.T) {
+		t.Parallel()
+
+		for _, mode := range []string{OFF, HEAT, COOL, HEATCOOL} {
+			n, err := targetModeToHAP(mode)
+			assert.NoError(t, err)
+
+			back, err := targetModeFromHAP(n)
+			assert.NoError(t, err)
+			assert.Equal(t, mode, back)
+		}
+	})
+
+	t.Run("unknown sdm mode", func(t *testing.T) {
+		t.Parallel()
+
+		_, err := targetModeToHAP("DEFROST")
+
+		var enumErr *UnknownEnumError
+		assert.True(t, errors.As(err, &enumErr))
+		assert.Equal(t, "ThermostatMode", enumErr.Enum)
+	})
+
+	t.Run("unknown homekit mode", func(t *testing.T) {
+		t.Parallel()
+
+		_, err := targetModeFromHAP(4)
+		assert.Error(t, err)
+	})
+}
+
+func TestCurrentModeToHAP(t *testing.T) {
+	t.Parallel()
+
+	n, err := currentModeToHAP(COOLING)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+
+	_, err = currentModeToHAP("FAN_ONLY")
+	assert.Error(t, err)
+}
+
+func TestDisplayUnitToHAP(t *testing.T) {
+	t.Parallel()
+
+	n, err := displayUnitToHAP(FAHRENHEIT)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+
+	_, err = displayUnitToHAP("KELVIN")
+	assert.Error(t, err)
+}
+
+func TestEnumCounter(t *testing.T) {
+	t.Parallel()
+
+	c := &enumCounter{}
+	c.report("device", errors.New("not an enum error"))
+	assert.Equal(t, 0, c.Total())
+
+	_, err := targetModeToHAP("DEFROST")
+	c.report("device", err)
+	c.report("device", err)
+	assert.Equal(t, 2, c.Total())
+}
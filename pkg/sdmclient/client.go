@@ -8,39 +8,81 @@ import (
 	sdm "google.golang.org/api/smartdevicemanagement/v1"
 )
 
+// Device is an SDM device that can be queried and controlled. DeviceEndpoint
+// implements it against the SDM API, Fake in memory.
+type Device interface {
+	GetDevice() (DeviceTraits, error)
+	SetMode(mode string) error
+	SetHeat(temp float64) error
+	SetCool(temp float64) error
+	SetHeatCool(heat, cool float64) error
+	SetEcoMode(mode string) error
+	SetFanTimer(mode string, duration time.Duration) error
+}
+
 type DeviceEndpoint struct {
 	*sdm.Service
 	Name string
 }
 
+// DeviceTraits are the thermostat traits of a device or of a pubsub update.
+// Updates only carry the traits that changed, so every value is a pointer
+// that is nil when absent, which tells it apart from a zero value.
 type DeviceTraits struct {
+	Connectivity struct {
+		Status *string
+	} `json:"sdm.devices.traits.Connectivity"`
 	CurrMode struct {
-		Status    string
-		Timestamp time.Time `json:"-"`
+		Status *string
 	} `json:"sdm.devices.traits.ThermostatHvac"`
 	CurrTemp struct {
-		TempCelsius float64   `json:"ambientTemperatureCelsius"`
-		Timestamp   time.Time `json:"-"`
+		TempCelsius *float64 `json:"ambientTemperatureCelsius"`
 	} `json:"sdm.devices.traits.Temperature"`
 	DisplayUnit struct {
-		Unit      string    `json:"temperatureScale"`
-		Timestamp time.Time `json:"-"`
+		Unit *string `json:"temperatureScale"`
 	} `json:"sdm.devices.traits.Settings"`
-	// TODO(nateinaction): Add support for humidity
-	// Humidity struct {
-	// 	Percent   float64   `json:"ambientHumidityPercent"`
-	// 	Timestamp time.Time `json:"-"`
-	// } `json:"sdm.devices.traits.Humidity"`
+	Humidity struct {
+		Percent *float64 `json:"ambientHumidityPercent"`
+	} `json:"sdm.devices.traits.Humidity"`
 	TargetMode struct {
-		Mode      string
-		Timestamp time.Time `json:"-"`
+		Mode *string
 	} `json:"sdm.devices.traits.ThermostatMode"`
 	TargetTemp struct {
-		HeatCelsius   float64
-		CoolCelsius   float64
-		HeatTimestamp time.Time `json:"-"`
-		CoolTimestamp time.Time `json:"-"`
+		HeatCelsius *float64
+		CoolCelsius *float64
 	} `json:"sdm.devices.traits.ThermostatTemperatureSetpoint"`
+	Eco struct {
+		Mode        *string
+		HeatCelsius *float64
+		CoolCelsius *float64
+	} `json:"sdm.devices.traits.ThermostatEco"`
+	Fan struct {
+		TimerMode *string
+	} `json:"sdm.devices.traits.Fan"`
+}
+
+// String returns a pointer to v, for setting DeviceTraits
+func String(v string) *string {
+	return &v
+}
+
+// Float returns a pointer to v, for setting DeviceTraits
+func Float(v float64) *float64 {
+	return &v
+}
+
+// DeviceEvents are the events carried by a pubsub resource update. An event is
+// nil unless it occurred.
+type DeviceEvents struct {
+	Motion *Event `json:"sdm.devices.events.CameraMotion.Motion"`
+	Person *Event `json:"sdm.devices.events.CameraPerson.Person"`
+	Sound  *Event `json:"sdm.devices.events.CameraSound.Sound"`
+	Chime  *Event `json:"sdm.devices.events.DoorbellChime.Chime"`
+}
+
+type Event struct {
+	EventSessionID string `json:"eventSessionId"`
+	EventID        string `json:"eventId"`
 }
 
 func (d *DeviceEndpoint) GetDevice() (DeviceTraits, error) {
@@ -163,3 +205,61 @@ func (d *DeviceEndpoint) SetHeatCool(heat, cool float64) error {
 
 	return nil
 }
+
+func (d *DeviceEndpoint) SetEcoMode(mode string) error {
+	type params struct {
+		Mode string `json:"mode"`
+	}
+
+	p := params{
+		Mode: mode,
+	}
+
+	ep, err := json.Marshal(p)
+	if err != nil {
+		return fmt.Errorf("failed to marshal eco mode params: %w", err)
+	}
+
+	req := &sdm.GoogleHomeEnterpriseSdmV1ExecuteDeviceCommandRequest{
+		Command: "sdm.devices.commands.ThermostatEco.SetMode",
+		Params:  ep,
+	}
+
+	if _, err := d.Enterprises.Devices.ExecuteCommand(d.Name, req).Do(); err != nil {
+		return fmt.Errorf("failed to set eco mode: %w", err)
+	}
+
+	return nil
+}
+
+func (d *DeviceEndpoint) SetFanTimer(mode string, duration time.Duration) error {
+	type params struct {
+		Mode     string `json:"timerMode"`
+		Duration string `json:"duration,omitempty"`
+	}
+
+	p := params{
+		Mode: mode,
+	}
+
+	// the duration is only accepted when turning the fan on, in whole seconds
+	if duration > 0 {
+		p.Duration = fmt.Sprintf("%ds", int64(duration.Seconds()))
+	}
+
+	ep, err := json.Marshal(p)
+	if err != nil {
+		return fmt.Errorf("failed to marshal fan timer params: %w", err)
+	}
+
+	req := &sdm.GoogleHomeEnterpriseSdmV1ExecuteDeviceCommandRequest{
+		Command: "sdm.devices.commands.Fan.SetTimer",
+		Params:  ep,
+	}
+
+	if _, err := d.Enterprises.Devices.ExecuteCommand(d.Name, req).Do(); err != nil {
+		return fmt.Errorf("failed to set fan timer: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,90 @@
+package sdmclient
+
+import (
+	"sync"
+	"time"
+)
+
+// Fake is an in-memory Device for tests. Commands are recorded and applied to
+// Traits the way the thermostat would, GetDevice returns Traits.
+type Fake struct {
+	sync.Mutex
+	Traits   DeviceTraits
+	Commands []Command
+
+	// Err fails every call while it is set
+	Err error
+}
+
+// Command is a command received by a Fake
+type Command struct {
+	Name string
+	Args []interface{}
+}
+
+func (f *Fake) GetDevice() (DeviceTraits, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	if f.Err != nil {
+		return DeviceTraits{}, f.Err
+	}
+
+	return f.Traits, nil
+}
+
+func (f *Fake) SetMode(mode string) error {
+	return f.execute("SetMode", func() { f.Traits.TargetMode.Mode = String(mode) }, mode)
+}
+
+func (f *Fake) SetHeat(temp float64) error {
+	return f.execute("SetHeat", func() { f.Traits.TargetTemp.HeatCelsius = Float(temp) }, temp)
+}
+
+func (f *Fake) SetCool(temp float64) error {
+	return f.execute("SetCool", func() { f.Traits.TargetTemp.CoolCelsius = Float(temp) }, temp)
+}
+
+func (f *Fake) SetHeatCool(heat, cool float64) error {
+	return f.execute("SetHeatCool", func() {
+		f.Traits.TargetTemp.HeatCelsius = Float(heat)
+		f.Traits.TargetTemp.CoolCelsius = Float(cool)
+	}, heat, cool)
+}
+
+func (f *Fake) SetEcoMode(mode string) error {
+	return f.execute("SetEcoMode", func() { f.Traits.Eco.Mode = String(mode) }, mode)
+}
+
+func (f *Fake) SetFanTimer(mode string, duration time.Duration) error {
+	return f.execute("SetFanTimer", func() { f.Traits.Fan.TimerMode = String(mode) }, mode, duration)
+}
+
+// LastCommand returns the most recent command, or an empty Command if none was
+// received
+func (f *Fake) LastCommand() Command {
+	f.Lock()
+	defer f.Unlock()
+
+	if len(f.Commands) == 0 {
+		return Command{}
+	}
+
+	return f.Commands[len(f.Commands)-1]
+}
+
+// execute records the command and applies it unless Err is set
+func (f *Fake) execute(name string, apply func(), args ...interface{}) error {
+	f.Lock()
+	defer f.Unlock()
+
+	f.Commands = append(f.Commands, Command{Name: name, Args: args})
+
+	if f.Err != nil {
+		return f.Err
+	}
+
+	apply()
+
+	return nil
+}
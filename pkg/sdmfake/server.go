@@ -0,0 +1,184 @@
+// Package sdmfake is a local stand-in for the SDM API, for testing nesthub
+// without network access or a Google account. Point sdm.NewService at it with
+// option.WithEndpoint(server.URL+"/") and option.WithoutAuthentication().
+package sdmfake
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+)
+
+// APIError is an error response in the format of Google APIs
+type APIError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+	Status  string `json:"status"`
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("%d %s: %s", e.Code, e.Status, e.Message)
+}
+
+func invalidArgument(msg string) *APIError {
+	return &APIError{Code: http.StatusBadRequest, Status: "INVALID_ARGUMENT", Message: msg}
+}
+
+func failedPrecondition(msg string) *APIError {
+	return &APIError{Code: http.StatusBadRequest, Status: "FAILED_PRECONDITION", Message: msg}
+}
+
+func notFound(msg string) *APIError {
+	return &APIError{Code: http.StatusNotFound, Status: "NOT_FOUND", Message: msg}
+}
+
+// ErrRateLimited is the error the SDM API returns when the quota is exhausted
+func ErrRateLimited() *APIError {
+	return &APIError{Code: http.StatusTooManyRequests, Status: "RESOURCE_EXHAUSTED", Message: "Rate limited."}
+}
+
+// Server serves the enterprises.devices list, get and executeCommand methods
+// of the SDM API for the thermostats of a single project
+type Server struct {
+	*httptest.Server
+
+	mu          sync.Mutex
+	project     string
+	thermostats []*Thermostat
+	fail        []*APIError
+	last        time.Time
+}
+
+// NewServer starts a server for project with the given thermostats. Close it
+// when done.
+func NewServer(project string, thermostats ...*Thermostat) *Server {
+	s := &Server{
+		project:     project,
+		thermostats: thermostats,
+		last:        time.Now(),
+	}
+	s.Server = httptest.NewServer(s)
+
+	return s
+}
+
+// Update runs f with the state of the thermostats locked, e.g. to take a
+// thermostat offline
+func (s *Server) Update(f func(thermostats []*Thermostat)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f(s.thermostats)
+}
+
+// FailNext makes the next requests fail with the given errors, in order
+func (s *Server) FailNext(errs ...*APIError) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.fail = append(s.fail, errs...)
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// the room follows the thermostats in real time
+	now := time.Now()
+	for _, t := range s.thermostats {
+		t.Step(now.Sub(s.last))
+	}
+
+	s.last = now
+
+	if len(s.fail) > 0 {
+		err := s.fail[0]
+		s.fail = s.fail[1:]
+		writeError(w, err)
+
+		return
+	}
+
+	resp, err := s.route(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp) //nolint:errcheck
+}
+
+// route dispatches a request to the list, get or executeCommand method
+func (s *Server) route(r *http.Request) (interface{}, *APIError) {
+	prefix := "/v1/enterprises/" + s.project + "/devices"
+	if !strings.HasPrefix(r.URL.Path, "/v1/enterprises/") {
+		return nil, notFound("Method not found.")
+	}
+
+	if !strings.HasPrefix(r.URL.Path, prefix) {
+		return nil, &APIError{Code: http.StatusForbidden, Status: "PERMISSION_DENIED", Message: "Permission denied."}
+	}
+
+	rest := strings.TrimPrefix(r.URL.Path, prefix)
+
+	switch {
+	case rest == "" && r.Method == http.MethodGet:
+		devices := make([]interface{}, 0, len(s.thermostats))
+		for _, t := range s.thermostats {
+			devices = append(devices, t.Device(s.project))
+		}
+
+		return map[string]interface{}{"devices": devices}, nil
+	case strings.HasSuffix(rest, ":executeCommand") && r.Method == http.MethodPost:
+		t := s.thermostat(strings.TrimSuffix(rest, ":executeCommand"))
+		if t == nil {
+			return nil, notFound("Device " + r.URL.Path + " not found.")
+		}
+
+		var req struct {
+			Command string          `json:"command"`
+			Params  json.RawMessage `json:"params"`
+		}
+
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			return nil, invalidArgument("Invalid JSON payload received.")
+		}
+
+		if err := t.Execute(req.Command, req.Params); err != nil {
+			return nil, err
+		}
+
+		return map[string]interface{}{"results": map[string]interface{}{}}, nil
+	case r.Method == http.MethodGet:
+		t := s.thermostat(rest)
+		if t == nil {
+			return nil, notFound("Device " + r.URL.Path + " not found.")
+		}
+
+		return t.Device(s.project), nil
+	default:
+		return nil, notFound("Method not found.")
+	}
+}
+
+// thermostat returns the thermostat of the path "/<id>", or nil
+func (s *Server) thermostat(path string) *Thermostat {
+	for _, t := range s.thermostats {
+		if path == "/"+t.ID {
+			return t
+		}
+	}
+
+	return nil
+}
+
+func writeError(w http.ResponseWriter, err *APIError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(err.Code)
+	json.NewEncoder(w).Encode(map[string]interface{}{"error": err}) //nolint:errcheck
+}
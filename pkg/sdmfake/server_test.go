@@ -0,0 +1,150 @@
+package sdmfake
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/yangl1996/nesthub/pkg/sdmclient"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/option"
+	sdm "google.golang.org/api/smartdevicemanagement/v1"
+)
+
+func newTestClient(t *testing.T, s *Server) *sdm.Service {
+	t.Helper()
+
+	svc, err := sdm.NewService(context.Background(), option.WithEndpoint(s.URL+"/"), option.WithoutAuthentication())
+	require.NoError(t, err)
+
+	return svc
+}
+
+func TestServer(t *testing.T) {
+	t.Parallel()
+
+	t.Run("list", func(t *testing.T) {
+		t.Parallel()
+		s := NewServer("project", NewThermostat("one"), NewThermostat("two"))
+		defer s.Close()
+
+		resp, err := newTestClient(t, s).Enterprises.Devices.List("enterprises/project").Do()
+		require.NoError(t, err)
+		require.Len(t, resp.Devices, 2)
+		assert.Equal(t, "enterprises/project/devices/one", resp.Devices[0].Name)
+		assert.Equal(t, "sdm.devices.types.THERMOSTAT", resp.Devices[0].Type)
+		assert.Equal(t, "Living Room", resp.Devices[0].ParentRelations[0].DisplayName)
+	})
+
+	t.Run("other project", func(t *testing.T) {
+		t.Parallel()
+		s := NewServer("project", NewThermostat("one"))
+		defer s.Close()
+
+		_, err := newTestClient(t, s).Enterprises.Devices.List("enterprises/other").Do()
+
+		var apiErr *googleapi.Error
+		require.True(t, errors.As(err, &apiErr))
+		assert.Equal(t, http.StatusForbidden, apiErr.Code)
+	})
+
+	t.Run("commands change the traits", func(t *testing.T) {
+		t.Parallel()
+		s := NewServer("project", NewThermostat("one"))
+		defer s.Close()
+
+		d := &sdmclient.DeviceEndpoint{Service: newTestClient(t, s), Name: "enterprises/project/devices/one"}
+
+		require.NoError(t, d.SetMode("HEATCOOL"))
+		require.NoError(t, d.SetHeatCool(19, 23))
+		require.NoError(t, d.SetFanTimer("ON", time.Hour))
+
+		traits, err := d.GetDevice()
+		require.NoError(t, err)
+		assert.Equal(t, "HEATCOOL", *traits.TargetMode.Mode)
+		assert.Equal(t, 19.0, *traits.TargetTemp.HeatCelsius)
+		assert.Equal(t, 23.0, *traits.TargetTemp.CoolCelsius)
+		assert.Equal(t, "ON", *traits.Fan.TimerMode)
+		assert.Equal(t, "ONLINE", *traits.Connectivity.Status)
+	})
+
+	t.Run("invalid commands", func(t *testing.T) {
+		t.Parallel()
+		s := NewServer("project", NewThermostat("one"))
+		defer s.Close()
+
+		d := &sdmclient.DeviceEndpoint{Service: newTestClient(t, s), Name: "enterprises/project/devices/one"}
+
+		// heat mode has no cool setpoint
+		assert.Error(t, d.SetCool(25))
+		assert.Error(t, d.SetHeat(40))
+		assert.Error(t, d.SetMode("DEFROST"))
+
+		require.NoError(t, d.SetEcoMode("MANUAL_ECO"))
+		assert.Error(t, d.SetHeat(21))
+
+		s.Update(func(ts []*Thermostat) { ts[0].Online = false })
+		assert.Error(t, d.SetEcoMode("OFF"))
+
+		traits, err := d.GetDevice()
+		require.NoError(t, err)
+		assert.Equal(t, "OFFLINE", *traits.Connectivity.Status)
+	})
+
+	t.Run("unknown device", func(t *testing.T) {
+		t.Parallel()
+		s := NewServer("project")
+		defer s.Close()
+
+		d := &sdmclient.DeviceEndpoint{Service: newTestClient(t, s), Name: "enterprises/project/devices/none"}
+
+		_, err := d.GetDevice()
+
+		var apiErr *googleapi.Error
+		require.True(t, errors.As(err, &apiErr))
+		assert.Equal(t, http.StatusNotFound, apiErr.Code)
+	})
+
+	t.Run("injected errors", func(t *testing.T) {
+		t.Parallel()
+		s := NewServer("project", NewThermostat("one"))
+		defer s.Close()
+
+		s.FailNext(ErrRateLimited())
+
+		d := &sdmclient.DeviceEndpoint{Service: newTestClient(t, s), Name: "enterprises/project/devices/one"}
+
+		_, err := d.GetDevice()
+
+		var apiErr *googleapi.Error
+		require.True(t, errors.As(err, &apiErr))
+		assert.Equal(t, http.StatusTooManyRequests, apiErr.Code)
+
+		_, err = d.GetDevice()
+		assert.NoError(t, err)
+	})
+}
+
+func TestThermostatStep(t *testing.T) {
+	t.Parallel()
+
+	th := NewThermostat("one")
+	assert.Equal(t, "HEATING", th.hvac())
+
+	th.Step(10 * time.Minute)
+	assert.InDelta(t, 19.0, th.Ambient, 0.001)
+
+	// the room never overshoots the setpoint
+	th.Step(time.Hour)
+	assert.Equal(t, 20.0, th.Ambient)
+	assert.Equal(t, "OFF", th.hvac())
+
+	th.Mode = "COOL"
+	th.CoolCelsius = 18
+	th.Step(10 * time.Minute)
+	assert.InDelta(t, 19.0, th.Ambient, 0.001)
+}
@@ -0,0 +1,293 @@
+package sdmfake
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+// Nest accepts setpoints between 9 and 32°C and keeps the setpoints of a range
+// at least 1.5°C apart
+const (
+	minSetpoint = 9.0
+	maxSetpoint = 32.0
+	minRange    = 1.5
+
+	// driftPerMinute is how fast the room follows the thermostat
+	driftPerMinute = 0.1
+
+	// hysteresis is how far the room may be off the setpoint before the
+	// thermostat starts heating or cooling
+	hysteresis = 0.5
+)
+
+// Thermostat is the simulated state of a Nest thermostat
+type Thermostat struct {
+	ID         string
+	CustomName string
+	Room       string
+	Online     bool
+	HasFan     bool
+
+	Mode        string // OFF, HEAT, COOL or HEATCOOL
+	EcoMode     string // OFF or MANUAL_ECO
+	HeatCelsius float64
+	CoolCelsius float64
+	EcoHeat     float64
+	EcoCool     float64
+	Ambient     float64
+	Humidity    float64
+	Scale       string // CELSIUS or FAHRENHEIT
+	FanTimeout  time.Time
+}
+
+// NewThermostat returns an online thermostat heating a room to 20°C
+func NewThermostat(id string) *Thermostat {
+	return &Thermostat{
+		ID:          id,
+		Room:        "Living Room",
+		Online:      true,
+		HasFan:      true,
+		Mode:        "HEAT",
+		EcoMode:     "OFF",
+		HeatCelsius: 20,
+		CoolCelsius: 24,
+		EcoHeat:     15,
+		EcoCool:     28,
+		Ambient:     18,
+		Humidity:    45,
+		Scale:       "CELSIUS",
+	}
+}
+
+// setpoints returns the heat and cool setpoints in effect
+func (t *Thermostat) setpoints() (float64, float64) {
+	if t.EcoMode == "MANUAL_ECO" {
+		return t.EcoHeat, t.EcoCool
+	}
+
+	return t.HeatCelsius, t.CoolCelsius
+}
+
+// hvac returns the status reported by the ThermostatHvac trait
+func (t *Thermostat) hvac() string {
+	heat, cool := t.setpoints()
+
+	heating := t.Mode == "HEAT" || t.Mode == "HEATCOOL"
+	cooling := t.Mode == "COOL" || t.Mode == "HEATCOOL"
+
+	switch {
+	case heating && t.Ambient < heat-hysteresis:
+		return "HEATING"
+	case cooling && t.Ambient > cool+hysteresis:
+		return "COOLING"
+	default:
+		return "OFF"
+	}
+}
+
+// Step moves the ambient temperature toward the setpoint as if d had passed
+func (t *Thermostat) Step(d time.Duration) {
+	if !t.Online {
+		return
+	}
+
+	heat, cool := t.setpoints()
+	delta := driftPerMinute * d.Minutes()
+
+	switch t.hvac() {
+	case "HEATING":
+		t.Ambient = math.Min(t.Ambient+delta, heat)
+	case "COOLING":
+		t.Ambient = math.Max(t.Ambient-delta, cool)
+	}
+}
+
+// Device returns the thermostat as listed by the SDM API
+func (t *Thermostat) Device(project string) map[string]interface{} {
+	name := "enterprises/" + project + "/devices/" + t.ID
+
+	connectivity := "OFFLINE"
+	if t.Online {
+		connectivity = "ONLINE"
+	}
+
+	// only the setpoints of the current mode are reported, and none in eco
+	setpoint := map[string]interface{}{}
+	if t.EcoMode != "MANUAL_ECO" {
+		if t.Mode == "HEAT" || t.Mode == "HEATCOOL" {
+			setpoint["heatCelsius"] = t.HeatCelsius
+		}
+
+		if t.Mode == "COOL" || t.Mode == "HEATCOOL" {
+			setpoint["coolCelsius"] = t.CoolCelsius
+		}
+	}
+
+	traits := map[string]interface{}{
+		"sdm.devices.traits.Info":         map[string]interface{}{"customName": t.CustomName},
+		"sdm.devices.traits.Connectivity": map[string]interface{}{"status": connectivity},
+		"sdm.devices.traits.Humidity":     map[string]interface{}{"ambientHumidityPercent": t.Humidity},
+		"sdm.devices.traits.Settings":     map[string]interface{}{"temperatureScale": t.Scale},
+		"sdm.devices.traits.Temperature":  map[string]interface{}{"ambientTemperatureCelsius": t.Ambient},
+		"sdm.devices.traits.ThermostatMode": map[string]interface{}{
+			"mode":           t.Mode,
+			"availableModes": []string{"HEAT", "COOL", "HEATCOOL", "OFF"},
+		},
+		"sdm.devices.traits.ThermostatEco": map[string]interface{}{
+			"mode":           t.EcoMode,
+			"availableModes": []string{"OFF", "MANUAL_ECO"},
+			"heatCelsius":    t.EcoHeat,
+			"coolCelsius":    t.EcoCool,
+		},
+		"sdm.devices.traits.ThermostatHvac":                map[string]interface{}{"status": t.hvac()},
+		"sdm.devices.traits.ThermostatTemperatureSetpoint": setpoint,
+	}
+
+	if t.HasFan {
+		fan := map[string]interface{}{"timerMode": "OFF"}
+		if time.Now().Before(t.FanTimeout) {
+			fan = map[string]interface{}{
+				"timerMode":    "ON",
+				"timerTimeout": t.FanTimeout.UTC().Format(time.RFC3339),
+			}
+		}
+
+		traits["sdm.devices.traits.Fan"] = fan
+	}
+
+	return map[string]interface{}{
+		"name":   name,
+		"type":   "sdm.devices.types.THERMOSTAT",
+		"traits": traits,
+		"parentRelations": []map[string]interface{}{{
+			"parent":      "enterprises/" + project + "/structures/structure/rooms/room",
+			"displayName": t.Room,
+		}},
+	}
+}
+
+// Execute applies an SDM command to the thermostat
+func (t *Thermostat) Execute(command string, params json.RawMessage) *APIError {
+	var p struct {
+		Mode        string   `json:"mode"`
+		HeatCelsius *float64 `json:"heatCelsius"`
+		CoolCelsius *float64 `json:"coolCelsius"`
+		TimerMode   string   `json:"timerMode"`
+		Duration    string   `json:"duration"`
+	}
+
+	if len(params) > 0 {
+		if err := json.Unmarshal(params, &p); err != nil {
+			return invalidArgument("Invalid command params.")
+		}
+	}
+
+	if !t.Online {
+		return failedPrecondition("Device is offline.")
+	}
+
+	switch command {
+	case "sdm.devices.commands.ThermostatMode.SetMode":
+		return t.setMode(p.Mode)
+	case "sdm.devices.commands.ThermostatEco.SetMode":
+		return t.setEcoMode(p.Mode)
+	case "sdm.devices.commands.ThermostatTemperatureSetpoint.SetHeat":
+		return t.setSetpoints("HEAT", p.HeatCelsius, nil)
+	case "sdm.devices.commands.ThermostatTemperatureSetpoint.SetCool":
+		return t.setSetpoints("COOL", nil, p.CoolCelsius)
+	case "sdm.devices.commands.ThermostatTemperatureSetpoint.SetRange":
+		return t.setSetpoints("HEATCOOL", p.HeatCelsius, p.CoolCelsius)
+	case "sdm.devices.commands.Fan.SetTimer":
+		if !t.HasFan {
+			return invalidArgument("Command not supported.")
+		}
+
+		return t.setFanTimer(p.TimerMode, p.Duration)
+	default:
+		return invalidArgument("Command not supported.")
+	}
+}
+
+func (t *Thermostat) setMode(mode string) *APIError {
+	switch mode {
+	case "HEAT", "COOL", "HEATCOOL", "OFF":
+		t.Mode = mode
+		return nil
+	default:
+		return invalidArgument("Invalid mode: " + mode)
+	}
+}
+
+func (t *Thermostat) setEcoMode(mode string) *APIError {
+	switch mode {
+	case "OFF", "MANUAL_ECO":
+		t.EcoMode = mode
+		return nil
+	default:
+		return invalidArgument("Invalid eco mode: " + mode)
+	}
+}
+
+// setSetpoints sets the heat and/or cool setpoint, which is only allowed in
+// the given thermostat mode and not in eco mode
+func (t *Thermostat) setSetpoints(mode string, heat, cool *float64) *APIError {
+	if t.EcoMode == "MANUAL_ECO" {
+		return failedPrecondition("Cannot change setpoints while in eco mode.")
+	}
+
+	if t.Mode != mode {
+		return failedPrecondition(fmt.Sprintf("Cannot set %s setpoint in %s mode.", strings.ToLower(mode), t.Mode))
+	}
+
+	if (mode != "COOL" && heat == nil) || (mode != "HEAT" && cool == nil) {
+		return invalidArgument("Missing setpoint.")
+	}
+
+	for _, v := range []*float64{heat, cool} {
+		if v != nil && (*v < minSetpoint || *v > maxSetpoint) {
+			return invalidArgument(fmt.Sprintf("Setpoint %.1f is out of range [%.0f, %.0f].", *v, minSetpoint, maxSetpoint))
+		}
+	}
+
+	if heat != nil && cool != nil && *cool-*heat < minRange {
+		return invalidArgument(fmt.Sprintf("Cool setpoint must be at least %.1f above heat setpoint.", minRange))
+	}
+
+	if heat != nil {
+		t.HeatCelsius = *heat
+	}
+
+	if cool != nil {
+		t.CoolCelsius = *cool
+	}
+
+	return nil
+}
+
+func (t *Thermostat) setFanTimer(mode, duration string) *APIError {
+	switch mode {
+	case "OFF":
+		t.FanTimeout = time.Time{}
+		return nil
+	case "ON":
+		d := 15 * time.Minute
+
+		if duration != "" {
+			parsed, err := time.ParseDuration(duration)
+			if err != nil || parsed < time.Second || parsed > 12*time.Hour {
+				return invalidArgument("Invalid duration: " + duration)
+			}
+
+			d = parsed
+		}
+
+		t.FanTimeout = time.Now().Add(d)
+
+		return nil
+	default:
+		return invalidArgument("Invalid timer mode: " + mode)
+	}
+}